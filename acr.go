@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// prefix of the ACR credential source specs, `acr:<registry host>`
+	credentialSourceACR = "acr:"
+
+	// username of registry credentials which are ACR refresh tokens
+	acrUsername             = "00000000-0000-0000-0000-000000000000"
+	azureResource           = "https://management.azure.com/"
+	acrHTTPTimeout          = 30 * time.Second
+	acrDefaultTokenLifetime = 3 * time.Hour
+)
+
+// acrCredentialSource exchanges an Azure AD token for a refresh token of an
+// Azure Container Registry, and keeps it until `CONFIG_ACR_REFRESH_BEFORE`
+// ahead of its expiry
+type acrCredentialSource struct {
+	registry string
+	client   *http.Client
+	now      func() time.Time
+
+	token expiringCredential
+}
+
+func newACRCredentialSource(registry string) (*acrCredentialSource, error) {
+	if registry == "" || strings.Contains(registry, "/") {
+		return nil, fmt.Errorf("Invalid ACR source [%s], expects `<registry host>` like `myregistry.azurecr.io`", registry)
+	}
+	for _, u := range []string{configAzureAuthorityHost, configAzureIMDSURL} {
+		if _, err := url.Parse(u); err != nil {
+			return nil, fmt.Errorf("Invalid Azure endpoint [%s]: %v", u, err)
+		}
+	}
+	return &acrCredentialSource{
+		registry: registry,
+		client:   &http.Client{Timeout: acrHTTPTimeout},
+		now:      time.Now,
+	}, nil
+}
+
+func (s *acrCredentialSource) DockerConfigJSON() (string, error) {
+	return s.token.get(s.now(), configACRRefreshBefore, func() (string, time.Time, error) {
+		aadToken, tenant, err := s.aadToken()
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		refreshToken, err := s.exchange(aadToken, tenant)
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		dockerConfigJSON, err := registriesDockerConfigJSON([]string{s.registry}, acrUsername, refreshToken)
+		return dockerConfigJSON, s.tokenExpiry(refreshToken), err
+	})
+}
+
+// aadToken returns an Azure AD access token and its tenant, with the client
+// credentials of `AZURE_TENANT_ID`, `AZURE_CLIENT_ID` and `AZURE_CLIENT_SECRET`
+// when they are set, or from the managed identity endpoint otherwise
+func (s *acrCredentialSource) aadToken() (string, string, error) {
+	tenant, clientID, clientSecret := os.Getenv("AZURE_TENANT_ID"), os.Getenv("AZURE_CLIENT_ID"), os.Getenv("AZURE_CLIENT_SECRET")
+	var req *http.Request
+	var err error
+	if clientSecret != "" {
+		if tenant == "" || clientID == "" {
+			return "", "", fmt.Errorf("`AZURE_CLIENT_SECRET` needs `AZURE_TENANT_ID` and `AZURE_CLIENT_ID`")
+		}
+		form := url.Values{
+			"grant_type":    {"client_credentials"},
+			"client_id":     {clientID},
+			"client_secret": {clientSecret},
+			"scope":         {azureResource + ".default"},
+		}
+		tokenURL := fmt.Sprintf("%s/%s/oauth2/v2.0/token", strings.TrimSuffix(configAzureAuthorityHost, "/"), url.PathEscape(tenant))
+		req, err = http.NewRequest(http.MethodPost, tokenURL, strings.NewReader(form.Encode()))
+		if err != nil {
+			return "", "", err
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	} else {
+		query := url.Values{"api-version": {"2018-02-01"}, "resource": {azureResource}}
+		// the client id selects a user-assigned identity
+		if clientID != "" {
+			query.Set("client_id", clientID)
+		}
+		req, err = http.NewRequest(http.MethodGet, strings.TrimSuffix(configAzureIMDSURL, "/")+"/metadata/identity/oauth2/token?"+query.Encode(), nil)
+		if err != nil {
+			return "", "", err
+		}
+		req.Header.Set("Metadata", "true")
+	}
+
+	var token struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := s.doJSONRequest(req, "Azure AD token", &token); err != nil {
+		return "", "", err
+	}
+	if token.AccessToken == "" {
+		return "", "", fmt.Errorf("Azure AD returned no access token")
+	}
+	return token.AccessToken, tenant, nil
+}
+
+// exchange exchanges an Azure AD access token for a refresh token of the
+// registry through its `/oauth2/exchange` endpoint
+func (s *acrCredentialSource) exchange(aadToken, tenant string) (string, error) {
+	form := url.Values{
+		"grant_type":   {"access_token"},
+		"service":      {s.registry},
+		"access_token": {aadToken},
+	}
+	if tenant != "" {
+		form.Set("tenant", tenant)
+	}
+	req, err := http.NewRequest(http.MethodPost, "https://"+s.registry+"/oauth2/exchange", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	var token struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := s.doJSONRequest(req, "ACR refresh token", &token); err != nil {
+		return "", err
+	}
+	if token.RefreshToken == "" {
+		return "", fmt.Errorf("Registry [%s] returned no refresh token", s.registry)
+	}
+	return token.RefreshToken, nil
+}
+
+func (s *acrCredentialSource) doJSONRequest(req *http.Request, what string, v interface{}) error {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("Failed to get %s: %v", what, err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("Failed to get %s: %v", what, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("Failed to get %s: %s %s", what, resp.Status, body)
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return fmt.Errorf("Failed to parse %s: %v", what, err)
+	}
+	return nil
+}
+
+// tokenExpiry reads the expiry of an ACR refresh token from its `exp` claim.
+// The token is not verified, the registry does that, and a token which cannot
+// be read is assumed to last as long as ACR refresh tokens usually do.
+func (s *acrCredentialSource) tokenExpiry(token string) time.Time {
+	parts := strings.Split(token, ".")
+	if len(parts) == 3 {
+		if payload, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(parts[1], "=")); err == nil {
+			var claims struct {
+				Exp json.Number `json:"exp"`
+			}
+			if json.Unmarshal(payload, &claims) == nil {
+				if exp, err := strconv.ParseInt(claims.Exp.String(), 10, 64); err == nil {
+					return time.Unix(exp, 0)
+				}
+			}
+		}
+	}
+	return s.now().Add(acrDefaultTokenLifetime)
+}
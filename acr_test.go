@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// newACRTestServer serves Azure AD, the managed identity endpoint and the
+// registry exchange, returning refresh tokens which expire at exp
+func newACRTestServer(exp time.Time, calls *int) *httptest.Server {
+	var server *httptest.Server
+	server = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/tenant-id/oauth2/v2.0/token":
+			if r.FormValue("grant_type") != "client_credentials" || r.FormValue("client_id") != "client-id" || r.FormValue("client_secret") != "client-secret" {
+				http.Error(w, `{"error":"invalid_client"}`, http.StatusUnauthorized)
+				return
+			}
+			w.Write([]byte(`{"token_type":"Bearer","expires_in":3599,"access_token":"aad-token"}`))
+		case "/metadata/identity/oauth2/token":
+			if r.Header.Get("Metadata") != "true" || r.URL.Query().Get("resource") != azureResource {
+				http.Error(w, `{"error":"invalid_request"}`, http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"token_type":"Bearer","expires_in":"86399","access_token":"aad-token"}`))
+		case "/oauth2/exchange":
+			registry, _ := url.Parse(server.URL)
+			if r.FormValue("grant_type") != "access_token" || r.FormValue("access_token") != "aad-token" || r.FormValue("service") != registry.Host {
+				http.Error(w, `{"errors":[{"code":"UNAUTHORIZED"}]}`, http.StatusUnauthorized)
+				return
+			}
+			*calls++
+			payload := base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d,"tenant":%q,"call":%d}`, exp.Unix(), r.FormValue("tenant"), *calls)))
+			fmt.Fprintf(w, `{"refresh_token":"header.%s.signature"}`, payload)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	return server
+}
+
+func TestACRCredentialSource(t *testing.T) {
+	defer prepareEnvs(nil)
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	calls := 0
+	server := newACRTestServer(now.Add(3*time.Hour), &calls)
+	defer server.Close()
+	registry, _ := url.Parse(server.URL)
+
+	configAzureAuthorityHost, configAzureIMDSURL = server.URL, server.URL
+	defer func() {
+		configAzureAuthorityHost, configAzureIMDSURL = "https://login.microsoftonline.com", "http://169.254.169.254"
+	}()
+
+	for _, testCase := range []struct {
+		name string
+		envs map[string]string
+	}{
+		{
+			name: "client credentials",
+			envs: map[string]string{"AZURE_TENANT_ID": "tenant-id", "AZURE_CLIENT_ID": "client-id", "AZURE_CLIENT_SECRET": "client-secret"},
+		},
+		{
+			name: "managed identity",
+		},
+	} {
+		prepareEnvs(testCase.envs)
+		calls = 0
+		source, err := newACRCredentialSource(registry.Host)
+		if err != nil {
+			t.Fatalf("newACRCredentialSource has error %v", err)
+		}
+		source.client = server.Client()
+		clock := now
+		source.now = func() time.Time { return clock }
+
+		first, err := source.DockerConfigJSON()
+		if err != nil {
+			t.Errorf("ACR credential source with %s has error %v", testCase.name, err)
+			continue
+		}
+		// the refresh token is reused until the refresh point ahead of its expiry
+		clock = now.Add(2 * time.Hour)
+		if actual, _ := source.DockerConfigJSON(); actual != first || calls != 1 {
+			t.Errorf("ACR credential source with %s expects the token to be reused, got %d calls", testCase.name, calls)
+		}
+		clock = now.Add(2*time.Hour + 31*time.Minute)
+		if actual, _ := source.DockerConfigJSON(); actual == first || calls != 2 {
+			t.Errorf("ACR credential source with %s expects a new token ahead of expiry, got %d calls", testCase.name, calls)
+		}
+	}
+}
+
+func TestACRTokenExpiry(t *testing.T) {
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	source := &acrCredentialSource{now: func() time.Time { return now }}
+	exp := now.Add(time.Hour)
+	token := "header." + base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf(`{"exp":%d}`, exp.Unix()))) + ".signature"
+	if actual := source.tokenExpiry(token); !actual.Equal(exp) {
+		t.Errorf("tokenExpiry expects %v but got %v", exp, actual)
+	}
+	if actual := source.tokenExpiry("opaque"); !actual.Equal(now.Add(acrDefaultTokenLifetime)) {
+		t.Errorf("tokenExpiry expects the default lifetime for an opaque token, got %v", actual)
+	}
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSignAWSRequest(t *testing.T) {
+	// the get-vanilla case of the AWS Signature Version 4 test suite
+	req, err := http.NewRequest(http.MethodGet, "https://example.amazonaws.com/", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	creds := awsCredentials{accessKeyID: "AKIDEXAMPLE", secretAccessKey: "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"}
+	signAWSRequest(req, nil, creds, "us-east-1", "service", time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC))
+
+	expected := "AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/service/aws4_request, SignedHeaders=host;x-amz-date, Signature=5fa00fa31553b73ebf1942676e86291e8372ff2a2260956d9b8aae1d763fbf31"
+	if actual := req.Header.Get("Authorization"); actual != expected {
+		t.Errorf("signAWSRequest expects Authorization %s but got %s", expected, actual)
+	}
+}
+
+func TestAWSCredentialsFromEnv(t *testing.T) {
+	defer prepareEnvs(nil)
+	client := &http.Client{}
+
+	prepareEnvs(nil)
+	if _, err := awsCredentialsFromEnv(client, ""); err == nil {
+		t.Errorf("awsCredentialsFromEnv expects error without credentials")
+	}
+
+	prepareEnvs(map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "SECRET", "AWS_SESSION_TOKEN": "TOKEN"})
+	creds, err := awsCredentialsFromEnv(client, "")
+	if err != nil {
+		t.Fatalf("awsCredentialsFromEnv has error %v", err)
+	}
+	if creds.accessKeyID != "AKID" || creds.secretAccessKey != "SECRET" || creds.sessionToken != "TOKEN" {
+		t.Errorf("awsCredentialsFromEnv returns unexpected credentials %+v", creds)
+	}
+
+	dir, err := ioutil.TempDir("", "imagepullsecret-patcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("web-identity-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	sts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("Action") != "AssumeRoleWithWebIdentity" || r.FormValue("RoleArn") != "arn:aws:iam::123456789012:role/patcher" || r.FormValue("WebIdentityToken") != "web-identity-token" {
+			http.Error(w, "unexpected request", http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <AccessKeyId>ASIAROLE</AccessKeyId>
+      <SecretAccessKey>ROLESECRET</SecretAccessKey>
+      <SessionToken>ROLETOKEN</SessionToken>
+      <Expiration>2030-01-01T00:00:00Z</Expiration>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`))
+	}))
+	defer sts.Close()
+
+	prepareEnvs(map[string]string{"AWS_ROLE_ARN": "arn:aws:iam::123456789012:role/patcher", "AWS_WEB_IDENTITY_TOKEN_FILE": tokenFile})
+	creds, err = awsCredentialsFromEnv(client, sts.URL)
+	if err != nil {
+		t.Fatalf("awsCredentialsFromEnv has error %v", err)
+	}
+	if creds.accessKeyID != "ASIAROLE" || creds.secretAccessKey != "ROLESECRET" || creds.sessionToken != "ROLETOKEN" ||
+		!creds.expiration.Equal(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)) {
+		t.Errorf("awsCredentialsFromEnv returns unexpected credentials of the role %+v", creds)
+	}
+}
@@ -0,0 +1,470 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/informers"
+	corelisters "k8s.io/client-go/listers/core/v1"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/client-go/util/workqueue"
+)
+
+const (
+	controllerName = "imagepullsecret-patcher"
+	// number of workers reconciling namespaces in parallel
+	controllerWorkers = 1
+)
+
+// controller watches namespaces, secrets and service accounts through shared
+// informers and reconciles every namespace touched by an event. Items in the
+// workqueue are namespace names.
+type controller struct {
+	k8s *k8sClient
+
+	informers       []cache.SharedIndexInformer
+	namespaceLister corelisters.NamespaceLister
+
+	queue        workqueue.RateLimitingInterface
+	resyncPeriod time.Duration
+	// set once the credential files are watched, the resync then leaves them
+	// to the watcher instead of reading them every period
+	filesWatched bool
+	// changes of the credential sources, which Run only starts reloading once
+	// the caches have synced and the credentials have been loaded
+	reloadCh chan struct{}
+
+	// state of the current full sync, started by resync
+	syncLock    sync.Mutex
+	syncPending map[string]bool
+	syncFailed  bool
+	syncStarted time.Time
+
+	// namespaces removed from the namespace cache, which may still exist but
+	// no longer match `CONFIG_NAMESPACE_SELECTOR`
+	deselectedLock sync.Mutex
+	deselected     map[string]bool
+}
+
+// newController creates a controller which resyncs all namespaces every resync period
+func newController(k8s *k8sClient, resync time.Duration) *controller {
+	// resync is driven by the controller itself, so that it knows when all
+	// namespaces have been processed
+	factory := informers.NewSharedInformerFactory(k8s.clientset, 0)
+	// namespaces are selected by the API server, so they have their own factory
+	namespaceFactory := informers.NewSharedInformerFactoryWithOptions(k8s.clientset, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = namespaceListOptions().LabelSelector
+		}))
+	// only the labeled managed secrets are cached rather than all secrets of
+	// the cluster, the others are read from the API server when needed
+	secretFactory := informers.NewSharedInformerFactoryWithOptions(k8s.clientset, 0,
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = labelSecretName
+		}))
+	namespaceInformer := namespaceFactory.Core().V1().Namespaces()
+	secretInformer := secretFactory.Core().V1().Secrets()
+	serviceAccountInformer := factory.Core().V1().ServiceAccounts()
+
+	// namespaces are reconciled from the caches, only the writes go to the
+	// API server
+	cached := *k8s
+	cached.secretLister = secretInformer.Lister()
+	cached.serviceAccountLister = serviceAccountInformer.Lister()
+
+	c := &controller{
+		k8s: &cached,
+		informers: []cache.SharedIndexInformer{
+			namespaceInformer.Informer(),
+			secretInformer.Informer(),
+			serviceAccountInformer.Informer(),
+		},
+		namespaceLister: namespaceInformer.Lister(),
+		queue:           workqueue.NewNamedRateLimitingQueue(workqueue.DefaultControllerRateLimiter(), controllerName),
+		resyncPeriod:    resync,
+		reloadCh:        make(chan struct{}, 1),
+		deselected:      map[string]bool{},
+	}
+
+	namespaceInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueNamespace,
+		UpdateFunc: func(_, obj interface{}) {
+			c.enqueueNamespace(obj)
+		},
+		DeleteFunc: c.enqueueDeselectedNamespace,
+	})
+	secretInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+		FilterFunc: isWatchedSecret,
+		Handler: cache.ResourceEventHandlerFuncs{
+			AddFunc: c.enqueueOwningNamespace,
+			UpdateFunc: func(_, obj interface{}) {
+				c.enqueueOwningNamespace(obj)
+			},
+			DeleteFunc: c.enqueueOwningNamespace,
+		},
+	})
+	// each source secret is watched on its own, read from its cache and
+	// reloaded as soon as it changes
+	for _, source := range secretCredentialSources() {
+		name := source.name
+		sourceInformer := informers.NewSharedInformerFactoryWithOptions(k8s.clientset, 0,
+			informers.WithNamespace(source.namespace),
+			informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+				options.FieldSelector = fields.OneTermEqualSelector("metadata.name", name).String()
+			})).Core().V1().Secrets()
+		source.lister = sourceInformer.Lister()
+		sourceInformer.Informer().AddEventHandler(cache.FilteringResourceEventHandler{
+			FilterFunc: isWatchedSourceSecret,
+			Handler: cache.ResourceEventHandlerFuncs{
+				AddFunc: func(_ interface{}) {
+					c.requestReload()
+				},
+				UpdateFunc: func(_, _ interface{}) {
+					c.requestReload()
+				},
+				DeleteFunc: func(_ interface{}) {
+					c.requestReload()
+				},
+			},
+		})
+		c.informers = append(c.informers, sourceInformer.Informer())
+	}
+	serviceAccountInformer.Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: c.enqueueOwningNamespace,
+		UpdateFunc: func(_, obj interface{}) {
+			c.enqueueOwningNamespace(obj)
+		},
+	})
+
+	return c
+}
+
+// Run starts the informers and workers, and blocks until stopCh is closed and
+// all of them have stopped, so that nothing is still writing once it returns
+func (c *controller) Run(workers int, stopCh <-chan struct{}) error {
+	defer utilruntime.HandleCrash()
+	var wg wait.Group
+	defer wg.Wait()
+	defer c.queue.ShutDown()
+
+	controllerHealth.setActive()
+	// the informers are run here rather than started by their factories,
+	// which cannot wait for the event handlers to return
+	for _, informer := range c.informers {
+		wg.StartWithChannel(stopCh, informer.Run)
+	}
+	log.Debug("Waiting for informer caches to sync")
+	var synced []cache.InformerSynced
+	for _, informer := range c.informers {
+		synced = append(synced, informer.HasSynced)
+	}
+	if !cache.WaitForCacheSync(stopCh, synced...) {
+		return fmt.Errorf("Failed to wait for caches to sync")
+	}
+	// the source secrets listed by the informers are loaded below
+	select {
+	case <-c.reloadCh:
+	default:
+	}
+
+	// start with the credentials loaded so far if some of them keep failing,
+	// their secrets are skipped until a later resync manages to load them
+	err := retryTransient(transientErrorBackoff, "Loading credentials", func() error {
+		_, err := refreshManagedSecrets()
+		return err
+	})
+	if err != nil {
+		log.Errorf("%v, starting without them", err)
+	}
+	if managedSecretsLoaded() {
+		controllerHealth.setCredentialsLoaded()
+	}
+	controllerHealth.setStarted(time.Now())
+	log.Info("Informer caches synced, starting workers")
+
+	if paths := credentialFilePaths(); len(paths) > 0 {
+		if err := watchCredentialFiles(paths, c.requestReload, stopCh); err != nil {
+			log.Warnf("Failed to watch credential files, they are reloaded every %v only: %v", c.resyncPeriod, err)
+		} else {
+			c.filesWatched = true
+		}
+	}
+	for i := 0; i < workers; i++ {
+		wg.StartWithChannel(stopCh, c.runWorker)
+	}
+	wg.Start(func() {
+		wait.Until(c.resync, c.resyncPeriod, stopCh)
+	})
+	wg.Start(func() {
+		for {
+			select {
+			case <-c.reloadCh:
+				c.reloadCredentials()
+			case <-stopCh:
+				return
+			}
+		}
+	})
+
+	<-stopCh
+	log.Info("Shutting down workers")
+	return nil
+}
+
+// resync reloads the managed secrets and enqueues every namespace, starting
+// a full sync which completes once all of them have been processed. A full
+// sync still pending is not restarted, so that it completes on large clusters
+// even when it takes longer than the resync period.
+func (c *controller) resync() {
+	refresh := refreshManagedSecrets
+	if c.filesWatched {
+		refresh = refreshUnwatchedSecrets
+	}
+	_, loadErr := refresh()
+	if loadErr != nil {
+		log.Errorf("%v, keep using the last loaded credentials", loadErr)
+	}
+	if managedSecretsLoaded() {
+		controllerHealth.setCredentialsLoaded()
+	}
+	namespaces, err := c.namespaceLister.List(namespaceSelector)
+	if err != nil {
+		log.Errorf("Failed to list namespaces from cache: %v", err)
+		return
+	}
+
+	c.syncLock.Lock()
+	if c.syncPending != nil {
+		log.Debugf("Full sync still has %d namespaces pending, not starting a new one", len(c.syncPending))
+		if loadErr != nil {
+			c.syncFailed = true
+		}
+	} else {
+		c.syncStarted = time.Now()
+		c.syncFailed = loadErr != nil
+		c.syncPending = make(map[string]bool, len(namespaces))
+		for _, ns := range namespaces {
+			c.syncPending[ns.Name] = true
+		}
+		if len(c.syncPending) == 0 {
+			c.completeSync()
+		}
+	}
+	c.syncLock.Unlock()
+
+	for _, ns := range namespaces {
+		c.queue.Add(ns.Name)
+	}
+}
+
+// requestReload asks Run to reload the credentials after a source has changed.
+// Requests made while a reload is already pending are merged into it.
+func (c *controller) requestReload() {
+	select {
+	case c.reloadCh <- struct{}{}:
+	default:
+	}
+}
+
+// reloadCredentials reloads the credentials after their sources have changed,
+// and resyncs all namespaces at once if any of them has actually changed
+func (c *controller) reloadCredentials() {
+	changed, err := refreshManagedSecrets()
+	if err != nil {
+		log.Warnf("%v, keep using the last loaded credentials", err)
+	}
+	if !changed {
+		log.Debug("Credential sources changed, but not the credentials")
+		return
+	}
+	log.Info("Credentials changed, resyncing all namespaces")
+	c.resync()
+}
+
+// markSynced records that a namespace has been processed in the current full sync
+func (c *controller) markSynced(namespace string, err error) {
+	c.syncLock.Lock()
+	defer c.syncLock.Unlock()
+	if !c.syncPending[namespace] {
+		return
+	}
+	delete(c.syncPending, namespace)
+	if err != nil {
+		c.syncFailed = true
+	}
+	if len(c.syncPending) == 0 {
+		c.completeSync()
+	}
+}
+
+// completeSync records the end of a full sync, syncLock must be held
+func (c *controller) completeSync() {
+	duration := time.Since(c.syncStarted)
+	metricSyncDuration.Observe(duration.Seconds())
+	controllerHealth.setSynced(time.Now())
+	if c.syncFailed {
+		log.Warnf("Full sync finished with errors in %v", duration)
+	} else {
+		metricLastSuccessfulSync.SetToCurrentTime()
+		log.Debugf("Full sync finished in %v", duration)
+	}
+	c.syncPending = nil
+}
+
+func (c *controller) enqueueNamespace(obj interface{}) {
+	if ns, ok := obj.(*corev1.Namespace); ok {
+		c.queue.Add(ns.Name)
+	}
+}
+
+// enqueueDeselectedNamespace enqueues a namespace removed from the namespace
+// cache. With a namespace selector, it is also removed when its labels stop
+// matching, so it is remembered to be checked against the API server.
+func (c *controller) enqueueDeselectedNamespace(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	if !namespaceSelector.Empty() {
+		c.deselectedLock.Lock()
+		c.deselected[key] = true
+		c.deselectedLock.Unlock()
+	}
+	c.queue.Add(key)
+}
+
+// enqueueOwningNamespace enqueues the namespace of a namespaced object,
+// including objects wrapped in a tombstone after a missed delete event
+func (c *controller) enqueueOwningNamespace(obj interface{}) {
+	key, err := cache.DeletionHandlingMetaNamespaceKeyFunc(obj)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	namespace, _, err := cache.SplitMetaNamespaceKey(key)
+	if err != nil {
+		utilruntime.HandleError(err)
+		return
+	}
+	c.queue.Add(namespace)
+}
+
+// runWorker processes the namespaces of the queue until stopCh is closed
+func (c *controller) runWorker(stopCh <-chan struct{}) {
+	wait.Until(func() {
+		for c.processNextItem(stopCh) {
+		}
+	}, time.Second, stopCh)
+}
+
+func (c *controller) processNextItem(stopCh <-chan struct{}) bool {
+	key, quit := c.queue.Get()
+	if quit {
+		return false
+	}
+	defer c.queue.Done(key)
+	// a shut down queue still hands out the remaining items, which are left
+	// to the next leader instead
+	select {
+	case <-stopCh:
+		return false
+	default:
+	}
+
+	err := c.reconcile(key.(string))
+	c.markSynced(key.(string), err)
+	if err != nil {
+		log.Error(err)
+		c.queue.AddRateLimited(key)
+		return true
+	}
+	c.queue.Forget(key)
+	return true
+}
+
+// reconcile makes sure the given namespace has a valid secret and patched
+// service accounts
+func (c *controller) reconcile(namespace string) error {
+	ns, err := c.namespaceLister.Get(namespace)
+	if errors.IsNotFound(err) {
+		return c.reconcileDeselected(namespace)
+	}
+	if err != nil {
+		return fmt.Errorf("[%s] Failed to get namespace from cache: %v", namespace, err)
+	}
+	c.forgetDeselected(namespace)
+	if !namespaceIsSelected(ns) {
+		log.Infof("[%s] Namespace is no longer selected", namespace)
+		return releaseNamespace(c.k8s, ns)
+	}
+	return processNamespace(c.k8s, *ns)
+}
+
+// reconcileDeselected handles a namespace missing from the namespace cache.
+// One which still exists but no longer matches `CONFIG_NAMESPACE_SELECTOR` is
+// released like an excluded namespace. The cache cannot tell it from a deleted
+// namespace, so it is read from the API server.
+func (c *controller) reconcileDeselected(namespace string) error {
+	c.deselectedLock.Lock()
+	deselected := c.deselected[namespace]
+	c.deselectedLock.Unlock()
+	if !deselected {
+		log.Debugf("[%s] Namespace is gone", namespace)
+		return nil
+	}
+
+	ns, err := c.k8s.clientset.CoreV1().Namespaces().Get(namespace, metav1.GetOptions{})
+	switch {
+	case errors.IsNotFound(err) || err == nil && ns.DeletionTimestamp != nil:
+		log.Debugf("[%s] Namespace is gone", namespace)
+	case err != nil:
+		metricErrors.WithLabelValues(operationGet).Inc()
+		return fmt.Errorf("[%s] Failed to get namespace: %v", namespace, err)
+	case namespaceIsSelected(ns):
+		log.Debugf("[%s] Namespace is selected again", namespace)
+	default:
+		log.Infof("[%s] Namespace is no longer selected", namespace)
+		if err := releaseNamespace(c.k8s, ns); err != nil {
+			return err
+		}
+	}
+	c.forgetDeselected(namespace)
+	return nil
+}
+
+func (c *controller) forgetDeselected(namespace string) {
+	c.deselectedLock.Lock()
+	delete(c.deselected, namespace)
+	c.deselectedLock.Unlock()
+}
+
+// isWatchedSecret filters secret events to the secrets managed by the patcher
+func isWatchedSecret(obj interface{}) bool {
+	switch secret := obj.(type) {
+	case *corev1.Secret:
+		return isManagedSecretName(secret.Name)
+	case cache.DeletedFinalStateUnknown:
+		return isWatchedSecret(secret.Obj)
+	}
+	return false
+}
+
+// isWatchedSourceSecret filters the source secrets of the credentials
+func isWatchedSourceSecret(obj interface{}) bool {
+	switch secret := obj.(type) {
+	case *corev1.Secret:
+		return isSourceSecret(secret.Namespace, secret.Name)
+	case cache.DeletedFinalStateUnknown:
+		return isWatchedSourceSecret(secret.Obj)
+	}
+	return false
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/cache"
+)
+
+func TestControllerReconcilesNewNamespace(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	configAllServiceAccount = false
+	managedSecrets = []*managedSecret{{name: configSecretName, source: staticCredentialSource(testDockerconfig)}}
+
+	k8s := &k8sClient{
+		clientset: fake.NewSimpleClientset(),
+	}
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	defer func() {
+		close(stopCh)
+		<-done
+	}()
+	go func() {
+		defer close(done)
+		if err := newController(k8s, time.Minute).Run(controllerWorkers, stopCh); err != nil {
+			t.Errorf("controller.Run failed: %v", err)
+		}
+	}()
+
+	namespace := "new-namespace"
+	if _, err := k8s.clientset.CoreV1().Namespaces().Create(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: namespace},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := k8s.clientset.CoreV1().ServiceAccounts(namespace).Create(&corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: defaultServiceAccountName, Namespace: namespace},
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		secret, err := k8s.clientset.CoreV1().Secrets(namespace).Get(configSecretName, metav1.GetOptions{})
+		if err != nil || verifySecret(secret, testDockerconfig) != secretOk {
+			return false, nil
+		}
+		sa, err := k8s.clientset.CoreV1().ServiceAccounts(namespace).Get(defaultServiceAccountName, metav1.GetOptions{})
+		if err != nil {
+			return false, nil
+		}
+		return includeImagePullSecret(sa, configSecretName), nil
+	})
+	if err != nil {
+		t.Errorf("controller did not reconcile namespace [%s]: %v", namespace, err)
+	}
+}
+
+func TestControllerReconcileMissingNamespace(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	c := newController(&k8sClient{clientset: fake.NewSimpleClientset()}, time.Minute)
+	if err := c.reconcile("missing"); err != nil {
+		t.Errorf("reconcile(missing) should ignore deleted namespaces, got %v", err)
+	}
+}
+
+func TestControllerFullSync(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	c := newController(&k8sClient{clientset: fake.NewSimpleClientset()}, time.Minute)
+
+	metricLastSuccessfulSync.Set(0)
+	c.syncStarted = time.Now()
+	c.syncPending = map[string]bool{"a": true, "b": true}
+	c.markSynced("a", nil)
+	c.markSynced("other", nil)
+	if testutil.ToFloat64(metricLastSuccessfulSync) != 0 {
+		t.Errorf("full sync should not complete before all namespaces are processed")
+	}
+	c.markSynced("b", nil)
+	if testutil.ToFloat64(metricLastSuccessfulSync) == 0 {
+		t.Errorf("full sync should complete after all namespaces are processed")
+	}
+
+	metricLastSuccessfulSync.Set(0)
+	c.syncStarted = time.Now()
+	c.syncPending = map[string]bool{"a": true}
+	c.markSynced("a", fmt.Errorf("test error"))
+	if testutil.ToFloat64(metricLastSuccessfulSync) != 0 {
+		t.Errorf("full sync with errors should not be recorded as successful")
+	}
+}
+
+func TestControllerResyncKeepsPendingSync(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	managedSecrets = []*managedSecret{{name: configSecretName, source: staticCredentialSource(testDockerconfig)}}
+	c := newController(&k8sClient{clientset: fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "a"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "b"}},
+	)}, time.Minute)
+	defer startInformers(t, c)()
+
+	metricLastSuccessfulSync.Set(0)
+	c.resync()
+	started := c.syncStarted
+	c.markSynced("a", nil)
+	// the next period starts while b is still pending
+	c.resync()
+	if !c.syncStarted.Equal(started) || len(c.syncPending) != 1 || !c.syncPending["b"] {
+		t.Fatalf("resync should not restart a pending full sync, pending %v", c.syncPending)
+	}
+	c.markSynced("b", nil)
+	if testutil.ToFloat64(metricLastSuccessfulSync) == 0 {
+		t.Errorf("full sync should complete after all namespaces are processed")
+	}
+
+	c.resync()
+	if len(c.syncPending) != 2 {
+		t.Errorf("resync should start a new full sync once the previous one completed, pending %v", c.syncPending)
+	}
+}
+
+func TestControllerReleasesDeselectedNamespace(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	namespaceSelector = labels.SelectorFromSet(labels.Set{"team": "a"})
+	defer func() {
+		namespaceSelector = labels.Everything()
+	}()
+	managedSecrets = []*managedSecret{{name: configSecretName, source: staticCredentialSource(testDockerconfig)}}
+
+	// the namespace was relabeled, so the label-filtered watch deleted it
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "b"}}}
+	secret := dockerconfigSecret("team-a", configSecretName, testDockerconfig)
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        defaultServiceAccountName,
+			Namespace:   "team-a",
+			Annotations: map[string]string{annotationImagepullsecretPatcherSecrets: configSecretName},
+		},
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: configSecretName}},
+	}
+	clientset := fake.NewSimpleClientset(ns, secret, sa)
+	c := newController(&k8sClient{clientset: clientset}, time.Minute)
+	defer startInformers(t, c)()
+
+	c.enqueueDeselectedNamespace(ns)
+	if err := c.reconcile("team-a"); err != nil {
+		t.Fatal(err)
+	}
+	patched, err := clientset.CoreV1().ServiceAccounts("team-a").Get(defaultServiceAccountName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if includeImagePullSecret(patched, configSecretName) {
+		t.Errorf("reconcile should remove the image pull secrets from a namespace no longer selected")
+	}
+	if len(c.deselected) != 0 {
+		t.Errorf("reconcile should forget the namespace once it is released, got %v", c.deselected)
+	}
+
+	c.enqueueDeselectedNamespace(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "deleted"}})
+	if err := c.reconcile("deleted"); err != nil {
+		t.Errorf("reconcile should ignore deleted namespaces, got %v", err)
+	}
+}
+
+func TestIsWatchedSecret(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		obj      interface{}
+		expected bool
+	}{
+		{
+			name:     "managed secret",
+			obj:      &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: configSecretName}},
+			expected: true,
+		},
+		{
+			name:     "other secret",
+			obj:      &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "other-secret"}},
+			expected: false,
+		},
+		{
+			name: "tombstone of managed secret",
+			obj: cache.DeletedFinalStateUnknown{
+				Key: fmt.Sprintf("default/%s", configSecretName),
+				Obj: &corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: configSecretName}},
+			},
+			expected: true,
+		},
+		{
+			name:     "not a secret",
+			obj:      &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: configSecretName}},
+			expected: false,
+		},
+	} {
+		if actual := isWatchedSecret(tc.obj); actual != tc.expected {
+			t.Errorf("isWatchedSecret(%s) gives %v, expects %v", tc.name, actual, tc.expected)
+		}
+	}
+}
+
+func TestControllerReloadCredentials(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	managedSecrets = []*managedSecret{{
+		name:             configSecretName,
+		source:           staticCredentialSource(testDockerconfig),
+		loaded:           true,
+		dockerConfigJSON: `{"auths":{}}`,
+	}}
+	c := newController(&k8sClient{clientset: fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}},
+	)}, time.Minute)
+	defer startInformers(t, c)()
+	// drop the item enqueued by the initial list of the namespace informer
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return c.queue.Len() == 1, nil
+	})
+	if err != nil {
+		t.Fatalf("namespace informer should enqueue the listed namespace: %v", err)
+	}
+	item, _ := c.queue.Get()
+	c.queue.Done(item)
+	c.queue.Forget(item)
+
+	c.reloadCredentials()
+	if c.queue.Len() != 1 {
+		t.Fatalf("reloadCredentials should enqueue all namespaces when the credentials changed, got %d items", c.queue.Len())
+	}
+	item, _ = c.queue.Get()
+	c.queue.Done(item)
+	c.queue.Forget(item)
+
+	c.reloadCredentials()
+	if c.queue.Len() != 0 {
+		t.Errorf("reloadCredentials should not enqueue anything when the credentials are unchanged, got %d items", c.queue.Len())
+	}
+}
+
+func TestControllerWatchesSourceSecret(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	configAllServiceAccount = false
+	source, err := parseSecretCredentialSource("imagepullsecret-patcher/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	managedSecrets = []*managedSecret{{name: configSecretName, source: source}}
+
+	k8s := &k8sClient{
+		clientset: fake.NewSimpleClientset(
+			&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}},
+			dockerconfigSecret("imagepullsecret-patcher", "src", `{"auths":{}}`),
+		),
+	}
+	connectSecretCredentialSources(k8s.clientset)
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	defer func() {
+		close(stopCh)
+		<-done
+	}()
+	c := newController(k8s, time.Hour)
+	go func() {
+		defer close(done)
+		if err := c.Run(controllerWorkers, stopCh); err != nil {
+			t.Errorf("controller.Run failed: %v", err)
+		}
+	}()
+
+	hasPayload := func(payload string) func() (bool, error) {
+		return func() (bool, error) {
+			secret, err := k8s.clientset.CoreV1().Secrets("team-a").Get(configSecretName, metav1.GetOptions{})
+			return err == nil && verifySecret(secret, payload) == secretOk, nil
+		}
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, hasPayload(`{"auths":{}}`)); err != nil {
+		t.Fatalf("controller did not distribute the source secret: %v", err)
+	}
+
+	// the resync period is an hour, so only the watch can pick up the change
+	if _, err := k8s.clientset.CoreV1().Secrets("imagepullsecret-patcher").Update(
+		dockerconfigSecret("imagepullsecret-patcher", "src", testDockerconfig)); err != nil {
+		t.Fatal(err)
+	}
+	if err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, hasPayload(testDockerconfig)); err != nil {
+		t.Errorf("controller did not resync after the source secret changed: %v", err)
+	}
+}
+
+func TestControllerIgnoresReloadsBeforeRun(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	controllerHealth = &healthState{active: true}
+	defer func() {
+		controllerHealth = &healthState{}
+	}()
+	source, err := parseSecretCredentialSource("imagepullsecret-patcher/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	managedSecrets = []*managedSecret{{name: configSecretName, source: source}}
+	clientset := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}},
+		dockerconfigSecret("imagepullsecret-patcher", "src", testDockerconfig),
+	)
+	connectSecretCredentialSources(clientset)
+	c := newController(&k8sClient{clientset: clientset}, time.Hour)
+
+	// the initial list of the source informer sees the source secret before
+	// Run has loaded the credentials
+	defer startInformers(t, c)()
+	err = wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		return len(c.reloadCh) == 1, nil
+	})
+	if err != nil {
+		t.Fatalf("source secret event should request a reload: %v", err)
+	}
+	if err := controllerHealth.ready(); err == nil {
+		t.Errorf("controller should not be ready before Run has synced the caches")
+	}
+}
+
+func TestControllerRunWaitsForWorkers(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	managedSecrets = []*managedSecret{{name: configSecretName, source: staticCredentialSource(testDockerconfig)}}
+
+	clientset := fake.NewSimpleClientset(&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}})
+	writing := make(chan struct{})
+	release := make(chan struct{})
+	var once sync.Once
+	clientset.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		once.Do(func() { close(writing) })
+		<-release
+		return false, nil, nil
+	})
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := newController(&k8sClient{clientset: clientset}, time.Hour).Run(controllerWorkers, stopCh); err != nil {
+			t.Errorf("controller.Run failed: %v", err)
+		}
+	}()
+
+	select {
+	case <-writing:
+	case <-time.After(5 * time.Second):
+		t.Fatal("controller did not start reconciling")
+	}
+	close(stopCh)
+	select {
+	case <-done:
+		t.Error("controller.Run should not return while a worker is still writing")
+	case <-time.After(100 * time.Millisecond):
+	}
+	close(release)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Error("controller.Run should return once the workers have stopped")
+	}
+}
+
+func TestControllerReadsFromCache(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	configAllServiceAccount = false
+	managedSecrets = []*managedSecret{{name: configSecretName, source: staticCredentialSource(testDockerconfig)}}
+
+	clientset := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: defaultServiceAccountName, Namespace: "team-a"}},
+		// a secret missing from the cache is read from the API server, as it
+		// may be an unlabeled one
+		dockerconfigSecret("team-a", configSecretName, testDockerconfig),
+	)
+	stopCh := make(chan struct{})
+	done := make(chan struct{})
+	defer func() {
+		close(stopCh)
+		<-done
+	}()
+	go func() {
+		defer close(done)
+		if err := newController(&k8sClient{clientset: clientset}, time.Hour).Run(controllerWorkers, stopCh); err != nil {
+			t.Errorf("controller.Run failed: %v", err)
+		}
+	}()
+
+	err := wait.PollImmediate(10*time.Millisecond, 5*time.Second, func() (bool, error) {
+		for _, action := range clientset.Actions() {
+			if action.Matches("patch", "serviceaccounts") {
+				return true, nil
+			}
+		}
+		return false, nil
+	})
+	if err != nil {
+		t.Fatalf("controller did not reconcile namespace [team-a]: %v", err)
+	}
+	// the only reads are the initial lists of the informers
+	reads := map[string]int{}
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() == "get" || action.GetVerb() == "list" {
+			reads[action.GetVerb()+" "+action.GetResource().Resource]++
+		}
+	}
+	for _, read := range []string{"get secrets", "get serviceaccounts"} {
+		if reads[read] != 0 {
+			t.Errorf("controller should not %s from the API server, got %d calls", read, reads[read])
+		}
+	}
+	for _, read := range []string{"list secrets", "list serviceaccounts"} {
+		if reads[read] != 1 {
+			t.Errorf("controller should %s from the API server once, got %d calls", read, reads[read])
+		}
+	}
+}
+
+// startInformers runs the informers of the controller until their caches have
+// synced, and returns a function stopping them.
+func startInformers(t *testing.T, c *controller) func() {
+	var wg wait.Group
+	stopCh := make(chan struct{})
+	stop := func() {
+		close(stopCh)
+		wg.Wait()
+	}
+	synced := []cache.InformerSynced{}
+	for _, informer := range c.informers {
+		wg.StartWithChannel(stopCh, informer.Run)
+		synced = append(synced, informer.HasSynced)
+	}
+	if !cache.WaitForCacheSync(stopCh, synced...) {
+		stop()
+		t.Fatal("informer caches did not sync")
+	}
+	return stop
+}
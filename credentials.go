@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
+)
+
+const (
+	// prefixes of the credential source specs in `CONFIG_SECRETS`
+	credentialSourceFile   = "file:"
+	credentialSourceEnv    = "env:"
+	credentialSourceSecret = "secret:"
+)
+
+// credentialSource provides the dockerconfigjson payload of a managed secret
+type credentialSource interface {
+	DockerConfigJSON() (string, error)
+}
+
+// staticCredentialSource is a payload given directly in the configuration
+type staticCredentialSource string
+
+func (s staticCredentialSource) DockerConfigJSON() (string, error) {
+	return string(s), nil
+}
+
+// fileCredentialSource reads the payload from a file, typically a mounted secret,
+// so that it can be updated without restarting the patcher
+type fileCredentialSource string
+
+func (s fileCredentialSource) DockerConfigJSON() (string, error) {
+	b, err := ioutil.ReadFile(string(s))
+	return string(b), err
+}
+
+// secretCredentialSource reads the payload from a Secret in the cluster, so
+// that it can be replaced without restarting the patcher
+type secretCredentialSource struct {
+	namespace string
+	name      string
+
+	// clientset is set once connected to the cluster, and lister once the
+	// controller watches the secrets, which is then read from its cache
+	clientset kubernetes.Interface
+	lister    corelisters.SecretLister
+}
+
+func (s *secretCredentialSource) DockerConfigJSON() (string, error) {
+	var secret *corev1.Secret
+	var err error
+	switch {
+	case s.lister != nil:
+		secret, err = s.lister.Secrets(s.namespace).Get(s.name)
+	case s.clientset != nil:
+		secret, err = s.clientset.CoreV1().Secrets(s.namespace).Get(s.name, metav1.GetOptions{})
+	default:
+		return "", fmt.Errorf("Source secret [%s/%s] cannot be read before connecting to the cluster", s.namespace, s.name)
+	}
+	if err != nil {
+		return "", fmt.Errorf("Failed to get source secret [%s/%s]: %v", s.namespace, s.name, err)
+	}
+	value, ok := secret.Data[corev1.DockerConfigJsonKey]
+	if !ok {
+		return "", fmt.Errorf("Source secret [%s/%s] has no key %s", s.namespace, s.name, corev1.DockerConfigJsonKey)
+	}
+	return string(value), nil
+}
+
+// expiringCredential keeps a payload built from a short-lived token until
+// some time ahead of its expiry, so that the token APIs are not called on
+// every resync and the payload is renewed before it stops working
+type expiringCredential struct {
+	lock      sync.Mutex
+	value     string
+	expiresAt time.Time
+}
+
+// get returns the kept payload, or fetches a new one once within
+// refreshBefore of the expiry
+func (c *expiringCredential) get(now time.Time, refreshBefore time.Duration, fetch func() (string, time.Time, error)) (string, error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.value != "" && now.Before(c.expiresAt.Add(-refreshBefore)) {
+		return c.value, nil
+	}
+	value, expiresAt, err := fetch()
+	if err != nil {
+		return "", err
+	}
+	c.value, c.expiresAt = value, expiresAt
+	return value, nil
+}
+
+// registriesDockerConfigJSON builds a dockerconfigjson payload giving the
+// same username and password to each of the registries
+func registriesDockerConfigJSON(registries []string, username, password string) (string, error) {
+	auths := map[string]map[string]string{}
+	for _, registry := range registries {
+		auths[registry] = map[string]string{
+			"username": username,
+			"password": password,
+			"auth":     base64.StdEncoding.EncodeToString([]byte(username + ":" + password)),
+		}
+	}
+	b, err := json.Marshal(map[string]interface{}{"auths": auths})
+	return string(b), err
+}
+
+// parseSecretCredentialSource parses a `namespace/name` reference to a Secret
+func parseSecretCredentialSource(ref string) (*secretCredentialSource, error) {
+	parts := strings.Split(ref, "/")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid source secret [%s], expects `namespace/name`", ref)
+	}
+	return &secretCredentialSource{namespace: parts[0], name: parts[1]}, nil
+}
+
+// secretCredentialSources returns the Secret credential sources of all
+// managed secrets and alternative credentials
+func secretCredentialSources() []*secretCredentialSource {
+	var sources []*secretCredentialSource
+	for _, ms := range allCredentials() {
+		if source, ok := ms.source.(*secretCredentialSource); ok {
+			sources = append(sources, source)
+		}
+	}
+	return sources
+}
+
+// isSourceSecret checks if a secret is the source of any credential
+func isSourceSecret(namespace, name string) bool {
+	for _, source := range secretCredentialSources() {
+		if source.namespace == namespace && source.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// managedSecret is an image pull secret distributed to every namespace
+// together with the last payload loaded from its credential source
+type managedSecret struct {
+	name   string
+	source credentialSource
+
+	lock             sync.RWMutex
+	loaded           bool
+	dockerConfigJSON string
+}
+
+// DockerConfigJSON returns the last successfully loaded payload, and false if
+// it has never been loaded
+func (ms *managedSecret) DockerConfigJSON() (string, bool) {
+	ms.lock.RLock()
+	defer ms.lock.RUnlock()
+	return ms.dockerConfigJSON, ms.loaded
+}
+
+// refresh reloads the payload from the credential source and reports whether
+// it has changed since the last load
+func (ms *managedSecret) refresh() (bool, error) {
+	value, err := ms.source.DockerConfigJSON()
+	if err != nil {
+		metricErrors.WithLabelValues(operationLoad).Inc()
+		return false, fmt.Errorf("[%s] Failed to load docker config json: %v", ms.name, err)
+	}
+	ms.lock.Lock()
+	defer ms.lock.Unlock()
+	changed := !ms.loaded || value != ms.dockerConfigJSON
+	ms.dockerConfigJSON = value
+	ms.loaded = true
+	return changed, nil
+}
+
+// allCredentials returns the managed secrets followed by the alternative
+// credentials, which are loaded the same way
+func allCredentials() []*managedSecret {
+	all := make([]*managedSecret, 0, len(managedSecrets)+len(alternativeCredentials))
+	all = append(all, managedSecrets...)
+	return append(all, alternativeCredentials...)
+}
+
+// managedSecretsLoaded checks if the credentials of all managed secrets and
+// alternative credentials have been loaded at least once
+func managedSecretsLoaded() bool {
+	for _, ms := range allCredentials() {
+		if _, loaded := ms.DockerConfigJSON(); !loaded {
+			return false
+		}
+	}
+	return true
+}
+
+// refreshManagedSecrets reloads every managed secret and alternative
+// credential and reports whether any of them has changed, a secret failing to
+// load keeps its previous payload
+func refreshManagedSecrets() (bool, error) {
+	return refreshCredentials(allCredentials())
+}
+
+// refreshUnwatchedSecrets is refreshManagedSecrets without the file credentials
+// already loaded, which the file watcher reloads as soon as they change
+func refreshUnwatchedSecrets() (bool, error) {
+	var unwatched []*managedSecret
+	for _, ms := range allCredentials() {
+		if _, ok := ms.source.(fileCredentialSource); ok {
+			if _, loaded := ms.DockerConfigJSON(); loaded {
+				continue
+			}
+		}
+		unwatched = append(unwatched, ms)
+	}
+	return refreshCredentials(unwatched)
+}
+
+func refreshCredentials(credentials []*managedSecret) (bool, error) {
+	changed := false
+	var errs []error
+	for _, ms := range credentials {
+		c, err := ms.refresh()
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		changed = changed || c
+	}
+	return changed, utilerrors.NewAggregate(errs)
+}
+
+// parseCredentialSource parses a credential source spec, which is one of
+// `file:<path>`, `env:<variable>`, `secret:<namespace>/<name>`, `ecr:<region>`, `gcr:[<key path>]`, `acr:<registry host>` or `vault:<mount>/<path>`
+func parseCredentialSource(spec string) (credentialSource, error) {
+	switch {
+	case strings.HasPrefix(spec, credentialSourceFile):
+		return fileCredentialSource(strings.TrimPrefix(spec, credentialSourceFile)), nil
+	case strings.HasPrefix(spec, credentialSourceSecret):
+		return parseSecretCredentialSource(strings.TrimPrefix(spec, credentialSourceSecret))
+	case strings.HasPrefix(spec, credentialSourceECR):
+		return newECRCredentialSource(strings.TrimPrefix(spec, credentialSourceECR))
+	case strings.HasPrefix(spec, credentialSourceGCR):
+		return newGCRCredentialSource(strings.TrimPrefix(spec, credentialSourceGCR))
+	case strings.HasPrefix(spec, credentialSourceACR):
+		return newACRCredentialSource(strings.TrimPrefix(spec, credentialSourceACR))
+	case strings.HasPrefix(spec, credentialSourceVault):
+		return newVaultCredentialSource(strings.TrimPrefix(spec, credentialSourceVault))
+	case strings.HasPrefix(spec, credentialSourceEnv):
+		name := strings.TrimPrefix(spec, credentialSourceEnv)
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			return nil, fmt.Errorf("Environment variable [%s] is not set", name)
+		}
+		return staticCredentialSource(value), nil
+	}
+	return nil, fmt.Errorf("Unknown credential source [%s], expects `file:<path>`, `env:<variable>`, `secret:<namespace>/<name>`, `ecr:<region>`, `gcr:[<key path>]`, `acr:<registry host>` or `vault:<mount>/<path>`", spec)
+}
+
+// parseManagedSecrets parses a comma-separated list of `name=source` pairs
+func parseManagedSecrets(list string) ([]*managedSecret, error) {
+	var secrets []*managedSecret
+	seen := map[string]bool{}
+	for _, pair := range strings.Split(list, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) != 2 || kv[0] == "" {
+			return nil, fmt.Errorf("Invalid secret [%s], expects `name=source`", pair)
+		}
+		name := strings.TrimSpace(kv[0])
+		if seen[name] {
+			return nil, fmt.Errorf("Secret [%s] is configured more than once", name)
+		}
+		seen[name] = true
+		source, err := parseCredentialSource(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid source for secret [%s]: %v", name, err)
+		}
+		secrets = append(secrets, &managedSecret{name: name, source: source})
+	}
+	return secrets, nil
+}
+
+// buildManagedSecrets returns the secrets configured by `CONFIG_SECRETS`, or
+// the single secret configured by `CONFIG_SECRETNAME` with one of
+// `CONFIG_DOCKERCONFIGJSON`, `CONFIG_DOCKERCONFIGJSONPATH` or `CONFIG_SOURCE_SECRET`
+func buildManagedSecrets() ([]*managedSecret, error) {
+	if configSecrets == "" {
+		var source credentialSource = staticCredentialSource(configDockerconfigjson)
+		if configDockerConfigJSONPath != "" {
+			source = fileCredentialSource(configDockerConfigJSONPath)
+		}
+		if configSourceSecret != "" {
+			if configDockerconfigjson != "" || configDockerConfigJSONPath != "" {
+				return nil, fmt.Errorf("Cannot specify `source-secret` together with `dockerconfigjson` or `dockerconfigjsonpath`")
+			}
+			secretSource, err := parseSecretCredentialSource(configSourceSecret)
+			if err != nil {
+				return nil, err
+			}
+			source = secretSource
+		}
+		return []*managedSecret{{name: configSecretName, source: source}}, nil
+	}
+	if configDockerconfigjson != "" || configDockerConfigJSONPath != "" || configSourceSecret != "" {
+		return nil, fmt.Errorf("Cannot specify `secrets` together with `dockerconfigjson`, `dockerconfigjsonpath` or `source-secret`")
+	}
+	secrets, err := parseManagedSecrets(configSecrets)
+	if err != nil {
+		return nil, err
+	}
+	if len(secrets) == 0 {
+		return nil, fmt.Errorf("No secret is configured in `secrets`")
+	}
+	return secrets, nil
+}
+
+// isManagedSecretName checks if a secret name is one of the managed secrets
+func isManagedSecretName(name string) bool {
+	for _, ms := range managedSecrets {
+		if ms.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// buildAlternativeCredentials returns the named credentials configured by
+// `CONFIG_CREDENTIAL_SOURCES`, which namespaces can select with an annotation
+func buildAlternativeCredentials() ([]*managedSecret, error) {
+	credentials, err := parseManagedSecrets(configCredentialSources)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid `credential-sources`: %v", err)
+	}
+	return credentials, nil
+}
+
+// namespaceCredentialSource returns the name of the alternative credential a
+// namespace selects for a managed secret with its annotation, which is either
+// a single name used for all managed secrets or a list of `secret=name` pairs.
+// It returns an empty string when the namespace uses the default credential.
+func namespaceCredentialSource(ns corev1.Namespace, secretName string) string {
+	value := strings.TrimSpace(ns.Annotations[annotationImagepullsecretPatcherCredentialSource])
+	if !strings.Contains(value, "=") {
+		return value
+	}
+	for _, pair := range strings.Split(value, ",") {
+		kv := strings.SplitN(pair, "=", 2)
+		if len(kv) == 2 && strings.TrimSpace(kv[0]) == secretName {
+			return strings.TrimSpace(kv[1])
+		}
+	}
+	return ""
+}
+
+// namespaceDockerConfigJSON returns the payload of a managed secret in a
+// namespace, taken from the alternative credential the namespace selects or
+// from the secret's own credential source otherwise
+func namespaceDockerConfigJSON(ns corev1.Namespace, ms *managedSecret) (string, error) {
+	credential := ms
+	if name := namespaceCredentialSource(ns, ms.name); name != "" {
+		credential = nil
+		for _, alt := range alternativeCredentials {
+			if alt.name == name {
+				credential = alt
+				break
+			}
+		}
+		if credential == nil {
+			return "", fmt.Errorf("Secret [%s] skipped, credential source [%s] is not configured", ms.name, name)
+		}
+	}
+	dockerConfigJSON, loaded := credential.DockerConfigJSON()
+	if !loaded {
+		return "", fmt.Errorf("Secret [%s] skipped, its credentials are not loaded", ms.name)
+	}
+	return dockerConfigJSON, nil
+}
+
+// connectSecretCredentialSources lets the Secret credential sources read
+// through the API
+func connectSecretCredentialSources(clientset kubernetes.Interface) {
+	for _, source := range secretCredentialSources() {
+		source.clientset = clientset
+	}
+}
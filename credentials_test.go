@@ -0,0 +1,324 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+var testCasesParseManagedSecrets = []struct {
+	name     string
+	envs     map[string]string
+	input    string
+	expected []string
+	hasError bool
+}{
+	{
+		name:     "empty",
+		input:    "",
+		expected: []string{},
+	},
+	{
+		name:     "file sources",
+		input:    "registry-a=file:/app/a/.dockerconfigjson,registry-b=file:/app/b/.dockerconfigjson",
+		expected: []string{"registry-a", "registry-b"},
+	},
+	{
+		name: "env source",
+		envs: map[string]string{
+			"REGISTRY_C": testDockerconfig,
+		},
+		input:    "registry-c=env:REGISTRY_C",
+		expected: []string{"registry-c"},
+	},
+	{
+		name:     "missing env",
+		input:    "registry-c=env:REGISTRY_C",
+		hasError: true,
+	},
+	{
+		name:     "secret source",
+		input:    "registry-d=secret:imagepullsecret-patcher/registry-d-src",
+		expected: []string{"registry-d"},
+	},
+	{
+		name:     "secret source without namespace",
+		input:    "registry-d=secret:registry-d-src",
+		hasError: true,
+	},
+	{
+		name:     "ecr source",
+		input:    "registry-e=ecr:us-east-1,registry-f=ecr:eu-west-1/123456789012",
+		expected: []string{"registry-e", "registry-f"},
+	},
+	{
+		name:     "ecr source without region",
+		input:    "registry-e=ecr:",
+		hasError: true,
+	},
+	{
+		name:     "gcr source",
+		input:    "registry-g=gcr:,registry-h=gcr:/app/secrets/key.json",
+		expected: []string{"registry-g", "registry-h"},
+	},
+	{
+		name:     "acr source",
+		input:    "registry-i=acr:myregistry.azurecr.io",
+		expected: []string{"registry-i"},
+	},
+	{
+		name:     "acr source without registry",
+		input:    "registry-i=acr:",
+		hasError: true,
+	},
+	{
+		name:     "vault source without address",
+		input:    "registry-j=vault:secret/registries/harbor",
+		hasError: true,
+	},
+	{
+		name:     "unknown source",
+		input:    "registry-a=http://example.com",
+		hasError: true,
+	},
+	{
+		name:     "no source",
+		input:    "registry-a",
+		hasError: true,
+	},
+	{
+		name:     "duplicated name",
+		input:    "registry-a=file:/a,registry-a=file:/b",
+		hasError: true,
+	},
+}
+
+func TestParseManagedSecrets(t *testing.T) {
+	for _, testCase := range testCasesParseManagedSecrets {
+		prepareEnvs(testCase.envs)
+		secrets, err := parseManagedSecrets(testCase.input)
+		if testCase.hasError {
+			if err == nil {
+				t.Errorf("parseManagedSecrets(%s) expects error but not", testCase.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseManagedSecrets(%s) has error %v", testCase.name, err)
+			continue
+		}
+		if len(secrets) != len(testCase.expected) {
+			t.Errorf("parseManagedSecrets(%s) gives %d secrets, expects %d", testCase.name, len(secrets), len(testCase.expected))
+			continue
+		}
+		for i, ms := range secrets {
+			if ms.name != testCase.expected[i] {
+				t.Errorf("parseManagedSecrets(%s) gives secret [%s], expects [%s]", testCase.name, ms.name, testCase.expected[i])
+			}
+		}
+	}
+}
+
+func TestBuildManagedSecretsLegacy(t *testing.T) {
+	configSecrets = ""
+	configDockerConfigJSONPath = ""
+	configDockerconfigjson = testDockerconfig
+	defer func() {
+		configDockerconfigjson = ""
+	}()
+
+	secrets, err := buildManagedSecrets()
+	if err != nil {
+		t.Fatalf("buildManagedSecrets has error %v", err)
+	}
+	if len(secrets) != 1 || secrets[0].name != configSecretName {
+		t.Fatalf("buildManagedSecrets expects a single secret [%s]", configSecretName)
+	}
+	if value, _ := secrets[0].source.DockerConfigJSON(); value != testDockerconfig {
+		t.Errorf("buildManagedSecrets gives payload %s, expects %s", value, testDockerconfig)
+	}
+
+	configSecrets = "registry-a=file:/a"
+	defer func() {
+		configSecrets = ""
+	}()
+	if _, err := buildManagedSecrets(); err == nil {
+		t.Errorf("buildManagedSecrets expects error when both `secrets` and `dockerconfigjson` are set")
+	}
+}
+
+func TestManagedSecretRefresh(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagepullsecret-patcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".dockerconfigjson")
+
+	ms := &managedSecret{name: "registry-a", source: fileCredentialSource(path)}
+	if _, err := ms.refresh(); err == nil {
+		t.Errorf("refresh expects error when file is missing")
+	}
+
+	for _, step := range []struct {
+		content string
+		changed bool
+	}{
+		{content: testDockerconfig, changed: true},
+		{content: testDockerconfig, changed: false},
+		{content: `{"auths":{}}`, changed: true},
+	} {
+		if err := ioutil.WriteFile(path, []byte(step.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		changed, err := ms.refresh()
+		if err != nil {
+			t.Errorf("refresh has error %v", err)
+		}
+		if changed != step.changed {
+			t.Errorf("refresh(%s) gives changed %v, expects %v", step.content, changed, step.changed)
+		}
+		if value, loaded := ms.DockerConfigJSON(); !loaded || value != step.content {
+			t.Errorf("refresh gives payload %s, expects %s", value, step.content)
+		}
+	}
+
+	// a failed reload keeps the previous payload
+	os.Remove(path)
+	if _, err := ms.refresh(); err == nil {
+		t.Errorf("refresh expects error when file is missing")
+	}
+	if value, loaded := ms.DockerConfigJSON(); !loaded || value != `{"auths":{}}` {
+		t.Errorf("refresh should keep the previous payload on error, got %s", value)
+	}
+}
+
+func TestRefreshUnwatchedSecrets(t *testing.T) {
+	dir, err := ioutil.TempDir("", "imagepullsecret-patcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, ".dockerconfigjson")
+	if err := ioutil.WriteFile(path, []byte(testDockerconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	managedSecrets = []*managedSecret{{name: "registry-a", source: fileCredentialSource(path)}}
+
+	// a file which has not been loaded yet is read
+	if changed, err := refreshUnwatchedSecrets(); err != nil || !changed {
+		t.Fatalf("refreshUnwatchedSecrets should load a new file credential, gives changed %v and error %v", changed, err)
+	}
+	if err := ioutil.WriteFile(path, []byte(`{"auths":{}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if changed, err := refreshUnwatchedSecrets(); err != nil || changed {
+		t.Errorf("refreshUnwatchedSecrets should leave a loaded file credential to the watcher, gives changed %v and error %v", changed, err)
+	}
+	if changed, err := refreshManagedSecrets(); err != nil || !changed {
+		t.Errorf("refreshManagedSecrets should reload a file credential, gives changed %v and error %v", changed, err)
+	}
+}
+
+func TestNamespaceDockerConfigJSON(t *testing.T) {
+	managedSecrets = []*managedSecret{
+		{name: "registry-a", loaded: true, dockerConfigJSON: "default-a"},
+		{name: "registry-b", loaded: true, dockerConfigJSON: "default-b"},
+	}
+	alternativeCredentials = []*managedSecret{
+		{name: "robot", loaded: true, dockerConfigJSON: "robot"},
+		{name: "not-loaded"},
+	}
+	defer func() {
+		alternativeCredentials = nil
+	}()
+
+	for _, tc := range []struct {
+		name       string
+		annotation string
+		expected   []string
+		hasError   []bool
+	}{
+		{
+			name:     "no annotation",
+			expected: []string{"default-a", "default-b"},
+			hasError: []bool{false, false},
+		},
+		{
+			name:       "single source",
+			annotation: "robot",
+			expected:   []string{"robot", "robot"},
+			hasError:   []bool{false, false},
+		},
+		{
+			name:       "source per secret",
+			annotation: "registry-b=robot",
+			expected:   []string{"default-a", "robot"},
+			hasError:   []bool{false, false},
+		},
+		{
+			name:       "unknown source",
+			annotation: "registry-a=missing",
+			expected:   []string{"", "default-b"},
+			hasError:   []bool{true, false},
+		},
+		{
+			name:       "source not loaded",
+			annotation: "not-loaded",
+			expected:   []string{"", ""},
+			hasError:   []bool{true, true},
+		},
+	} {
+		ns := corev1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name: "tenant",
+				Annotations: map[string]string{
+					annotationImagepullsecretPatcherCredentialSource: tc.annotation,
+				},
+			},
+		}
+		for i, ms := range managedSecrets {
+			value, err := namespaceDockerConfigJSON(ns, ms)
+			if hasError := err != nil; hasError != tc.hasError[i] {
+				t.Errorf("namespaceDockerConfigJSON(%s, %s) has error %v, expects error %v", tc.name, ms.name, err, tc.hasError[i])
+			}
+			if value != tc.expected[i] {
+				t.Errorf("namespaceDockerConfigJSON(%s, %s) gives %s, expects %s", tc.name, ms.name, value, tc.expected[i])
+			}
+		}
+	}
+}
+
+func TestSecretCredentialSource(t *testing.T) {
+	source, err := parseSecretCredentialSource("imagepullsecret-patcher/src")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := source.DockerConfigJSON(); err == nil {
+		t.Errorf("secret source expects error before connecting to the cluster")
+	}
+
+	source.clientset = fake.NewSimpleClientset()
+	if _, err := source.DockerConfigJSON(); err == nil {
+		t.Errorf("secret source expects error when the secret is missing")
+	}
+
+	source.clientset = fake.NewSimpleClientset(&corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "src", Namespace: "imagepullsecret-patcher"},
+		Type:       corev1.SecretTypeOpaque,
+		Data:       map[string][]byte{"token": []byte("abc")},
+	})
+	if _, err := source.DockerConfigJSON(); err == nil {
+		t.Errorf("secret source expects error when the secret has no %s", corev1.DockerConfigJsonKey)
+	}
+
+	source.clientset = fake.NewSimpleClientset(dockerconfigSecret("imagepullsecret-patcher", "src", testDockerconfig))
+	if value, err := source.DockerConfigJSON(); err != nil || value != testDockerconfig {
+		t.Errorf("secret source gives %s, %v, expects %s", value, err, testDockerconfig)
+	}
+}
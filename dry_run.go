@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// output formats of dry run
+	dryRunOutputText = "text"
+	dryRunOutputJSON = "json"
+)
+
+// namespacePlan is the list of changes processNamespace would make to a namespace
+type namespacePlan struct {
+	Namespace       string       `json:"namespace"`
+	Excluded        bool         `json:"excluded,omitempty"`
+	Secrets         []secretPlan `json:"secrets,omitempty"`
+	ServiceAccounts []string     `json:"serviceAccounts,omitempty"`
+	// service accounts whose image pull secrets added by the patcher would be removed
+	UnpatchedServiceAccounts []string `json:"unpatchedServiceAccounts,omitempty"`
+	Errors                   []string `json:"errors,omitempty"`
+}
+
+// dryRun walks all namespaces like loop, but writes the plan of every
+// namespace to out instead of changing anything
+func dryRun(k8s *k8sClient, out io.Writer, format string) error {
+	if format != dryRunOutputText && format != dryRunOutputJSON {
+		return fmt.Errorf("Unknown dry run output [%s], expects `%s` or `%s`", format, dryRunOutputText, dryRunOutputJSON)
+	}
+	if _, err := refreshManagedSecrets(); err != nil {
+		return err
+	}
+	namespaces, err := k8s.clientset.CoreV1().Namespaces().List(namespaceListOptions())
+	if err != nil {
+		return fmt.Errorf("Failed to list namespaces: %v", err)
+	}
+	log.Debugf("Got %d namespaces", len(namespaces.Items))
+
+	plans := make([]namespacePlan, 0, len(namespaces.Items))
+	for _, ns := range namespaces.Items {
+		plans = append(plans, planNamespace(k8s, ns))
+	}
+	if format == dryRunOutputJSON {
+		encoder := json.NewEncoder(out)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plans)
+	}
+	return writePlansText(out, plans)
+}
+
+// planNamespace reads the secrets and service accounts of a namespace and
+// decides the changes to make, the same way processNamespace does
+func planNamespace(k8s *k8sClient, ns corev1.Namespace) namespacePlan {
+	namespace := ns.Name
+	plan := namespacePlan{Namespace: namespace}
+	if namespaceIsExcluded(ns) {
+		plan.Excluded = true
+		sas, err := k8s.clientset.CoreV1().ServiceAccounts(namespace).List(metav1.ListOptions{})
+		if err != nil {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("Failed to list service accounts: %v", err))
+			return plan
+		}
+		for _, sa := range sas.Items {
+			if len(trackedImagePullSecrets(&sa)) > 0 {
+				plan.UnpatchedServiceAccounts = append(plan.UnpatchedServiceAccounts, sa.Name)
+			}
+		}
+		if configCleanupExcluded {
+			secrets, err := listManagedSecrets(k8s, namespace)
+			if err != nil {
+				plan.Errors = append(plan.Errors, err.Error())
+				return plan
+			}
+			for _, secret := range secrets {
+				plan.Secrets = append(plan.Secrets, secretPlan{Name: secret.Name, Action: secretActionDelete})
+			}
+		}
+		return plan
+	}
+
+	var secretNames []string
+	for _, ms := range managedSecrets {
+		dockerConfigJSON, err := namespaceDockerConfigJSON(ns, ms)
+		if err != nil {
+			plan.Errors = append(plan.Errors, err.Error())
+			continue
+		}
+		secret, err := k8s.clientset.CoreV1().Secrets(namespace).Get(ms.name, metav1.GetOptions{})
+		if errors.IsNotFound(err) {
+			secret = nil
+		} else if err != nil {
+			plan.Errors = append(plan.Errors, fmt.Sprintf("Failed to GET secret [%s]: %v", ms.name, err))
+			continue
+		}
+		secretPlan := planSecret(ms.name, secret, dockerConfigJSON)
+		plan.Secrets = append(plan.Secrets, secretPlan)
+		if !secretPlan.isRefused() {
+			secretNames = append(secretNames, ms.name)
+		}
+	}
+	if len(secretNames) == 0 {
+		return plan
+	}
+
+	sas, err := k8s.clientset.CoreV1().ServiceAccounts(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		plan.Errors = append(plan.Errors, fmt.Sprintf("Failed to list service accounts: %v", err))
+		return plan
+	}
+	for _, sa := range sas.Items {
+		if !serviceAccountIsTargeted(&sa) {
+			if len(trackedImagePullSecrets(&sa)) > 0 {
+				plan.UnpatchedServiceAccounts = append(plan.UnpatchedServiceAccounts, sa.Name)
+			}
+			continue
+		}
+		if !includeImagePullSecrets(&sa, secretNames) {
+			plan.ServiceAccounts = append(plan.ServiceAccounts, sa.Name)
+		}
+	}
+
+	// like processNamespace, the stale secrets are only removed once all
+	// configured secrets are in place
+	if len(plan.Errors) > 0 || len(secretNames) < len(managedSecrets) {
+		return plan
+	}
+	stale, err := listStaleSecrets(k8s, namespace)
+	if err != nil {
+		plan.Errors = append(plan.Errors, err.Error())
+		return plan
+	}
+	var staleNames []string
+	for _, secret := range stale {
+		plan.Secrets = append(plan.Secrets, secretPlan{Name: secret.Name, Action: secretActionDelete})
+		staleNames = append(staleNames, secret.Name)
+	}
+	for _, sa := range sas.Items {
+		if len(staleNames) > 0 && serviceAccountReferencesAny(&sa, staleNames) && stringNotInSlice(sa.Name, plan.UnpatchedServiceAccounts) {
+			plan.UnpatchedServiceAccounts = append(plan.UnpatchedServiceAccounts, sa.Name)
+		}
+	}
+	return plan
+}
+
+// writePlansText writes the plans as human readable lines
+func writePlansText(out io.Writer, plans []namespacePlan) error {
+	for _, plan := range plans {
+		var lines []string
+		if plan.Excluded {
+			lines = append(lines, "Namespace would be skipped")
+		}
+		for _, secret := range plan.Secrets {
+			switch secret.Action {
+			case secretActionNone:
+				lines = append(lines, fmt.Sprintf("Secret [%s] would be left alone", secret.Name))
+			case secretActionCreate:
+				lines = append(lines, fmt.Sprintf("Secret [%s] would be created", secret.Name))
+			case secretActionUpdate:
+				lines = append(lines, fmt.Sprintf("Secret [%s] would be updated (%s)", secret.Name, secret.Reason))
+			case secretActionReplace:
+				lines = append(lines, fmt.Sprintf("Secret [%s] would be replaced (%s)", secret.Name, secret.Reason))
+			case secretActionRefuseUnmanaged:
+				lines = append(lines, fmt.Sprintf("Secret [%s] would be refused, it is present but unmanaged", secret.Name))
+			case secretActionDelete:
+				lines = append(lines, fmt.Sprintf("Secret [%s] would be deleted", secret.Name))
+			case secretActionRefuseNoForce:
+				lines = append(lines, fmt.Sprintf("Secret [%s] would be refused (%s), set --force to true to overwrite", secret.Name, secret.Reason))
+			}
+		}
+		for _, sa := range plan.ServiceAccounts {
+			lines = append(lines, fmt.Sprintf("Service account [%s] would be patched", sa))
+		}
+		for _, sa := range plan.UnpatchedServiceAccounts {
+			lines = append(lines, fmt.Sprintf("Service account [%s] would have the added imagePullSecrets removed", sa))
+		}
+		for _, e := range plan.Errors {
+			lines = append(lines, fmt.Sprintf("Error: %s", e))
+		}
+		for _, line := range lines {
+			if _, err := fmt.Fprintf(out, "[%s] %s\n", plan.Namespace, line); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
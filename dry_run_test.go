@@ -0,0 +1,165 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func newDryRunTestClient() *fake.Clientset {
+	return fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "fresh"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "outdated"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{
+			Name:        "excluded",
+			Annotations: map[string]string{annotationImagepullsecretPatcherExclude: "true"},
+		}},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: defaultServiceAccountName, Namespace: "fresh"}},
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        defaultServiceAccountName,
+				Namespace:   "excluded",
+				Annotations: map[string]string{annotationImagepullsecretPatcherSecrets: configSecretName},
+			},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: configSecretName}},
+		},
+		&corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "other", Namespace: "fresh"}},
+		&corev1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Name: defaultServiceAccountName, Namespace: "outdated"},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: configSecretName}},
+		},
+		&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: configSecretName, Namespace: "outdated"},
+			Type:       corev1.SecretTypeDockerConfigJson,
+			Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{}}`)},
+		},
+	)
+}
+
+func prepareDryRunConfig() {
+	logrus.SetOutput(ioutil.Discard)
+	configForce = true
+	configManagedOnly = false
+	configAllServiceAccount = false
+	configServiceAccounts = defaultServiceAccountName
+	excludedNamespaces = nil
+	managedSecrets = []*managedSecret{{name: configSecretName, source: staticCredentialSource(testDockerconfig)}}
+}
+
+func TestDryRunJSON(t *testing.T) {
+	prepareDryRunConfig()
+	clientset := newDryRunTestClient()
+	k8s := &k8sClient{clientset: clientset}
+
+	var out bytes.Buffer
+	if err := dryRun(k8s, &out, dryRunOutputJSON); err != nil {
+		t.Fatalf("dryRun has error %v", err)
+	}
+	var plans []namespacePlan
+	if err := json.Unmarshal(out.Bytes(), &plans); err != nil {
+		t.Fatalf("dryRun gives invalid json %s: %v", out.String(), err)
+	}
+
+	expected := map[string]namespacePlan{
+		"fresh": {
+			Namespace:       "fresh",
+			Secrets:         []secretPlan{{Name: configSecretName, Action: secretActionCreate}},
+			ServiceAccounts: []string{defaultServiceAccountName},
+		},
+		"outdated": {
+			Namespace: "outdated",
+			Secrets:   []secretPlan{{Name: configSecretName, Action: secretActionUpdate, Reason: secretDataNotMatch}},
+		},
+		"excluded": {
+			Namespace:                "excluded",
+			Excluded:                 true,
+			UnpatchedServiceAccounts: []string{defaultServiceAccountName},
+		},
+	}
+	if len(plans) != len(expected) {
+		t.Fatalf("dryRun gives %d plans, expects %d", len(plans), len(expected))
+	}
+	for _, plan := range plans {
+		if !reflect.DeepEqual(plan, expected[plan.Namespace]) {
+			t.Errorf("dryRun(%s) gives %+v, expects %+v", plan.Namespace, plan, expected[plan.Namespace])
+		}
+	}
+
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() != "get" && action.GetVerb() != "list" {
+			t.Errorf("dryRun should not change anything, but called %s %s", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+}
+
+func TestDryRunText(t *testing.T) {
+	prepareDryRunConfig()
+	configForce = false
+	defer func() {
+		configForce = true
+	}()
+	k8s := &k8sClient{clientset: newDryRunTestClient()}
+
+	var out bytes.Buffer
+	if err := dryRun(k8s, &out, dryRunOutputText); err != nil {
+		t.Fatalf("dryRun has error %v", err)
+	}
+	for _, line := range []string{
+		"[fresh] Secret [image-pull-secret] would be created",
+		"[fresh] Service account [default] would be patched",
+		"[outdated] Secret [image-pull-secret] would be refused (SecretDataNotMatch), set --force to true to overwrite",
+		"[excluded] Namespace would be skipped",
+		"[excluded] Service account [default] would have the added imagePullSecrets removed",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("dryRun output should contain %q, got:\n%s", line, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "[fresh] Service account [other]") {
+		t.Errorf("dryRun should not patch untargeted service accounts, got:\n%s", out.String())
+	}
+}
+
+func TestDryRunCleanupExcluded(t *testing.T) {
+	prepareDryRunConfig()
+	configCleanupExcluded = true
+	defer func() {
+		configCleanupExcluded = false
+	}()
+	clientset := newDryRunTestClient()
+	managed := dockerconfigSecret("excluded", configSecretName, testDockerconfig)
+	if _, err := clientset.CoreV1().Secrets("excluded").Create(managed); err != nil {
+		t.Fatal(err)
+	}
+	clientset.ClearActions()
+	k8s := &k8sClient{clientset: clientset}
+
+	var out bytes.Buffer
+	if err := dryRun(k8s, &out, dryRunOutputText); err != nil {
+		t.Fatalf("dryRun has error %v", err)
+	}
+	if line := "[excluded] Secret [image-pull-secret] would be deleted\n"; !strings.Contains(out.String(), line) {
+		t.Errorf("dryRun output should contain %q, got:\n%s", line, out.String())
+	}
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() != "get" && action.GetVerb() != "list" {
+			t.Errorf("dryRun should not change anything, but called %s %s", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+}
+
+func TestDryRunUnknownOutput(t *testing.T) {
+	prepareDryRunConfig()
+	k8s := &k8sClient{clientset: fake.NewSimpleClientset()}
+	if err := dryRun(k8s, ioutil.Discard, "yaml"); err == nil {
+		t.Errorf("dryRun expects error for unknown output format")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// prefix of the ECR credential source specs, `ecr:<region>` or
+	// `ecr:<region>/<registry id>`
+	credentialSourceECR = "ecr:"
+
+	ecrTarget          = "AmazonEC2ContainerRegistry_V20150921.GetAuthorizationToken"
+	ecrContentType     = "application/x-amz-json-1.1"
+	ecrHTTPTimeout     = 30 * time.Second
+	awsCredentialsSkew = 5 * time.Minute
+)
+
+// ecrCredentialSource gets an authorization token from Amazon ECR and keeps
+// it until `CONFIG_ECR_REFRESH_BEFORE` ahead of its expiry, when it fetches a
+// new one. Since the managed secrets are reloaded on every resync, the new
+// token reaches all namespaces at the next resync after that point.
+type ecrCredentialSource struct {
+	region     string
+	registryID string
+	// endpoint overrides the regional ECR API endpoint
+	endpoint string
+	client   *http.Client
+	now      func() time.Time
+
+	token          expiringCredential
+	awsCredentials awsCredentials
+}
+
+func newECRCredentialSource(spec string) (*ecrCredentialSource, error) {
+	parts := strings.Split(spec, "/")
+	if len(parts) > 2 || parts[0] == "" || (len(parts) == 2 && parts[1] == "") {
+		return nil, fmt.Errorf("Invalid ECR source [%s], expects `<region>` or `<region>/<registry id>`", spec)
+	}
+	source := &ecrCredentialSource{
+		region:   parts[0],
+		endpoint: configECREndpoint,
+		client:   &http.Client{Timeout: ecrHTTPTimeout},
+		now:      time.Now,
+	}
+	if len(parts) == 2 {
+		source.registryID = parts[1]
+	}
+	if source.endpoint == "" {
+		source.endpoint = fmt.Sprintf("https://api.ecr.%s.amazonaws.com", source.region)
+	}
+	if _, err := url.Parse(source.endpoint); err != nil {
+		return nil, fmt.Errorf("Invalid ECR endpoint [%s]: %v", source.endpoint, err)
+	}
+	return source, nil
+}
+
+func (s *ecrCredentialSource) DockerConfigJSON() (string, error) {
+	return s.token.get(s.now(), configECRRefreshBefore, s.getAuthorizationToken)
+}
+
+type ecrGetAuthorizationTokenRequest struct {
+	RegistryIds []string `json:"registryIds,omitempty"`
+}
+
+type ecrGetAuthorizationTokenResponse struct {
+	AuthorizationData []struct {
+		AuthorizationToken string  `json:"authorizationToken"`
+		ExpiresAt          float64 `json:"expiresAt"`
+		ProxyEndpoint      string  `json:"proxyEndpoint"`
+	} `json:"authorizationData"`
+}
+
+// getAuthorizationToken calls the ECR `GetAuthorizationToken` API and returns
+// the dockerconfigjson payload built from the token, and its expiry
+func (s *ecrCredentialSource) getAuthorizationToken() (string, time.Time, error) {
+	creds, err := s.credentials()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	input := ecrGetAuthorizationTokenRequest{}
+	if s.registryID != "" {
+		input.RegistryIds = []string{s.registryID}
+	}
+	body, err := json.Marshal(input)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("Content-Type", ecrContentType)
+	req.Header.Set("X-Amz-Target", ecrTarget)
+	signAWSRequest(req, body, creds, s.region, "ecr", s.now())
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Failed to get ECR authorization token: %v", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Failed to get ECR authorization token: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", time.Time{}, fmt.Errorf("Failed to get ECR authorization token: %s %s", resp.Status, respBody)
+	}
+	var output ecrGetAuthorizationTokenResponse
+	if err := json.Unmarshal(respBody, &output); err != nil {
+		return "", time.Time{}, fmt.Errorf("Failed to parse ECR authorization token: %v", err)
+	}
+	if len(output.AuthorizationData) == 0 {
+		return "", time.Time{}, fmt.Errorf("ECR returned no authorization token")
+	}
+	data := output.AuthorizationData[0]
+	dockerConfigJSON, err := ecrDockerConfigJSON(data.ProxyEndpoint, data.AuthorizationToken)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	seconds := int64(data.ExpiresAt)
+	expiresAt := time.Unix(seconds, int64((data.ExpiresAt-float64(seconds))*float64(time.Second)))
+	return dockerConfigJSON, expiresAt, nil
+}
+
+// credentials returns the AWS credentials, reloading them shortly before
+// temporary credentials expire, it is only called while holding the token lock
+func (s *ecrCredentialSource) credentials() (awsCredentials, error) {
+	creds := s.awsCredentials
+	if creds.accessKeyID != "" && (creds.expiration.IsZero() || s.now().Before(creds.expiration.Add(-awsCredentialsSkew))) {
+		return creds, nil
+	}
+	creds, err := awsCredentialsFromEnv(s.client, configAWSSTSEndpoint)
+	if err != nil {
+		return creds, err
+	}
+	s.awsCredentials = creds
+	return creds, nil
+}
+
+// ecrDockerConfigJSON builds the dockerconfigjson payload of an ECR
+// authorization token, which is the base64 of `AWS:<password>`
+func ecrDockerConfigJSON(proxyEndpoint, token string) (string, error) {
+	decoded, err := base64.StdEncoding.DecodeString(token)
+	if err != nil {
+		return "", fmt.Errorf("Invalid ECR authorization token: %v", err)
+	}
+	userPass := strings.SplitN(string(decoded), ":", 2)
+	if len(userPass) != 2 {
+		return "", fmt.Errorf("Invalid ECR authorization token, expects `user:password`")
+	}
+	registry := strings.TrimPrefix(strings.TrimPrefix(proxyEndpoint, "https://"), "http://")
+	return registriesDockerConfigJSON([]string{registry}, userPass[0], userPass[1])
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestECRDockerConfigJSON(t *testing.T) {
+	token := base64.StdEncoding.EncodeToString([]byte("AWS:password"))
+	actual, err := ecrDockerConfigJSON("https://123456789012.dkr.ecr.us-east-1.amazonaws.com", token)
+	if err != nil {
+		t.Fatalf("ecrDockerConfigJSON has error %v", err)
+	}
+	expected := `{"auths":{"123456789012.dkr.ecr.us-east-1.amazonaws.com":{"auth":"` + token + `","password":"password","username":"AWS"}}}`
+	if actual != expected {
+		t.Errorf("ecrDockerConfigJSON expects %s but got %s", expected, actual)
+	}
+	if _, err := ecrDockerConfigJSON("https://123456789012.dkr.ecr.us-east-1.amazonaws.com", "not base64"); err == nil {
+		t.Errorf("ecrDockerConfigJSON expects error for an invalid token")
+	}
+}
+
+func TestECRCredentialSource(t *testing.T) {
+	defer prepareEnvs(nil)
+	prepareEnvs(map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "SECRET"})
+
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	calls := 0
+	ecr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Amz-Target") != ecrTarget || !strings.HasPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 Credential=AKID/20200101/us-east-1/ecr/aws4_request") {
+			http.Error(w, `{"__type":"UnrecognizedClientException"}`, http.StatusBadRequest)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		var input ecrGetAuthorizationTokenRequest
+		if err := json.Unmarshal(body, &input); err != nil || len(input.RegistryIds) != 1 || input.RegistryIds[0] != "123456789012" {
+			http.Error(w, `{"__type":"InvalidParameterException"}`, http.StatusBadRequest)
+			return
+		}
+		calls++
+		token := base64.StdEncoding.EncodeToString([]byte(fmt.Sprintf("AWS:password-%d", calls)))
+		fmt.Fprintf(w, `{"authorizationData":[{"authorizationToken":%q,"expiresAt":%d,"proxyEndpoint":"https://123456789012.dkr.ecr.us-east-1.amazonaws.com"}]}`,
+			token, now.Add(12*time.Hour).Unix())
+	}))
+	defer ecr.Close()
+
+	configECREndpoint = ecr.URL
+	defer func() { configECREndpoint = "" }()
+	source, err := newECRCredentialSource("us-east-1/123456789012")
+	if err != nil {
+		t.Fatalf("newECRCredentialSource has error %v", err)
+	}
+	clock := now
+	source.now = func() time.Time { return clock }
+	ms := &managedSecret{name: configSecretName, source: source}
+
+	if changed, err := ms.refresh(); err != nil || !changed {
+		t.Fatalf("refresh expects the first token to be loaded, got changed %v, error %v", changed, err)
+	}
+	first, _ := ms.DockerConfigJSON()
+	if !strings.Contains(first, base64.StdEncoding.EncodeToString([]byte("AWS:password-1"))) {
+		t.Errorf("ECR credential source returns unexpected payload %s", first)
+	}
+
+	// the token is reused until the refresh point ahead of its expiry
+	clock = now.Add(10 * time.Hour)
+	if changed, err := ms.refresh(); err != nil || changed {
+		t.Errorf("refresh expects the token to be reused, got changed %v, error %v", changed, err)
+	}
+	if calls != 1 {
+		t.Errorf("ECR credential source expects 1 call before the refresh point, got %d", calls)
+	}
+
+	clock = now.Add(11*time.Hour + time.Minute)
+	if changed, err := ms.refresh(); err != nil || !changed {
+		t.Errorf("refresh expects a new token ahead of expiry, got changed %v, error %v", changed, err)
+	}
+	if calls != 2 {
+		t.Errorf("ECR credential source expects 2 calls after the refresh point, got %d", calls)
+	}
+}
+
+func TestECRCredentialSourceError(t *testing.T) {
+	defer prepareEnvs(nil)
+	prepareEnvs(map[string]string{"AWS_ACCESS_KEY_ID": "AKID", "AWS_SECRET_ACCESS_KEY": "SECRET"})
+
+	ecr := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, `{"__type":"AccessDeniedException"}`, http.StatusBadRequest)
+	}))
+	defer ecr.Close()
+
+	configECREndpoint = ecr.URL
+	defer func() { configECREndpoint = "" }()
+	source, err := newECRCredentialSource("us-east-1")
+	if err != nil {
+		t.Fatalf("newECRCredentialSource has error %v", err)
+	}
+	if _, err := source.DockerConfigJSON(); err == nil || !strings.Contains(err.Error(), "AccessDeniedException") {
+		t.Errorf("ECR credential source expects the API error, got %v", err)
+	}
+}
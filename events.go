@@ -0,0 +1,138 @@
+package main
+
+import (
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/util/clock"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+const (
+	// reasons of the events recorded by the patcher
+	eventReasonSecretCreated           = "SecretCreated"
+	eventReasonSecretUpdated           = "SecretUpdated"
+	eventReasonSecretReplaced          = "SecretReplaced"
+	eventReasonSecretDeleted           = "SecretDeleted"
+	eventReasonSecretRefused           = "SecretOverwriteRefused"
+	eventReasonServiceAccountPatched   = "ServiceAccountPatched"
+	eventReasonServiceAccountUnpatched = "ServiceAccountUnpatched"
+
+	// time given to the events to be written before the patcher exits
+	eventFlushTimeout = 10 * time.Second
+)
+
+// eventRecorder records events through a broadcaster and writes them to the
+// API server, keeping count of the events not written yet so that they can be
+// flushed before the process exits. The broadcaster of client-go cannot be
+// flushed, as its Shutdown does not wait for the sink.
+type eventRecorder struct {
+	record.EventRecorder
+	sink       record.EventSink
+	correlator *record.EventCorrelator
+	pending    sync.WaitGroup
+}
+
+// newEventRecorder creates a recorder sending events to the API server
+func newEventRecorder(clientset kubernetes.Interface) *eventRecorder {
+	r := &eventRecorder{
+		sink:       &typedcorev1.EventSinkImpl{Interface: clientset.CoreV1().Events("")},
+		correlator: record.NewEventCorrelator(clock.RealClock{}),
+	}
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartLogging(log.Debugf)
+	broadcaster.StartEventWatcher(r.write)
+	r.EventRecorder = broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: controllerName})
+	return r
+}
+
+// Event records an event, which is written asynchronously
+func (r *eventRecorder) Event(obj runtime.Object, eventtype, reason, message string) {
+	r.pending.Add(1)
+	r.EventRecorder.Event(obj, eventtype, reason, message)
+}
+
+// Eventf records an event, which is written asynchronously
+func (r *eventRecorder) Eventf(obj runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.pending.Add(1)
+	r.EventRecorder.Eventf(obj, eventtype, reason, messageFmt, args...)
+}
+
+// PastEventf records an event, which is written asynchronously
+func (r *eventRecorder) PastEventf(obj runtime.Object, timestamp metav1.Time, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.pending.Add(1)
+	r.EventRecorder.PastEventf(obj, timestamp, eventtype, reason, messageFmt, args...)
+}
+
+// AnnotatedEventf records an event, which is written asynchronously
+func (r *eventRecorder) AnnotatedEventf(obj runtime.Object, annotations map[string]string, eventtype, reason, messageFmt string, args ...interface{}) {
+	r.pending.Add(1)
+	r.EventRecorder.AnnotatedEventf(obj, annotations, eventtype, reason, messageFmt, args...)
+}
+
+// write writes an event to the API server, as an update of a similar event
+// recorded before when the correlator aggregates them. An event which cannot
+// be written is logged and dropped.
+func (r *eventRecorder) write(event *corev1.Event) {
+	defer r.pending.Done()
+	// the event is shared with the logging watcher
+	copied := *event
+	result, err := r.correlator.EventCorrelate(&copied)
+	if err != nil {
+		log.Warnf("Failed to correlate event [%s]: %v", event.Reason, err)
+	}
+	if result == nil || result.Skip {
+		return
+	}
+	var written *corev1.Event
+	if result.Event.Count > 1 {
+		written, err = r.sink.Patch(result.Event, result.Patch)
+	}
+	if result.Event.Count <= 1 || errors.IsNotFound(err) {
+		result.Event.ResourceVersion = ""
+		written, err = r.sink.Create(result.Event)
+	}
+	if err != nil {
+		log.Warnf("Failed to write event [%s] of [%s/%s]: %v", event.Reason, event.InvolvedObject.Namespace, event.InvolvedObject.Name, err)
+		return
+	}
+	r.correlator.UpdateState(written)
+}
+
+// flush waits until the recorded events are written, or until timeout as an
+// event dropped by the broadcaster is never written
+func (r *eventRecorder) flush(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		r.pending.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+		log.Warnf("Timed out after %v waiting for events to be written", timeout)
+	}
+}
+
+// recordEvent records an event on an object, unless the client has no recorder
+func (k8s *k8sClient) recordEvent(obj runtime.Object, eventtype, reason, messageFmt string, args ...interface{}) {
+	if k8s.recorder == nil {
+		return
+	}
+	k8s.recorder.Eventf(obj, eventtype, reason, messageFmt, args...)
+}
+
+// recordSecretEvent records an event on a secret and on its namespace, so
+// that it is kept even when the secret is deleted later
+func (k8s *k8sClient) recordSecretEvent(ns *corev1.Namespace, secret *corev1.Secret, eventtype, reason, messageFmt string, args ...interface{}) {
+	k8s.recordEvent(secret, eventtype, reason, messageFmt, args...)
+	k8s.recordEvent(ns, eventtype, reason, messageFmt, args...)
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"io/ioutil"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/client-go/tools/record"
+)
+
+var testCasesEvents = []struct {
+	name      string
+	force     bool
+	prepSteps []step
+	testStep  step
+	expected  []string
+}{
+	{
+		name:     "secret created",
+		force:    true,
+		testStep: processSecretDefault,
+		expected: []string{
+			"Normal SecretCreated Created secret [image-pull-secret]",
+			"Normal SecretCreated Created secret [image-pull-secret]",
+		},
+	},
+	{
+		name:      "secret updated",
+		force:     true,
+		prepSteps: []step{helperCreateOutdatedSecret},
+		testStep:  processSecretDefault,
+		expected: []string{
+			"Normal SecretUpdated Updated secret [image-pull-secret] (SecretDataNotMatch)",
+			"Normal SecretUpdated Updated secret [image-pull-secret] (SecretDataNotMatch)",
+		},
+	},
+	{
+		name:      "secret replaced",
+		force:     true,
+		prepSteps: []step{helperCreateOpaqueSecret},
+		testStep:  processSecretDefault,
+		expected: []string{
+			"Warning SecretReplaced Replaced secret [image-pull-secret] (SecretWrongType)",
+			"Warning SecretReplaced Replaced secret [image-pull-secret] (SecretWrongType)",
+		},
+	},
+	{
+		name:      "overwrite refused",
+		force:     false,
+		prepSteps: []step{helperCreateOutdatedSecret},
+		testStep:  assertHasError(processSecretDefault),
+		expected: []string{
+			"Warning SecretOverwriteRefused Refused to overwrite secret [image-pull-secret] (SecretDataNotMatch), force is disabled",
+			"Warning SecretOverwriteRefused Refused to overwrite secret [image-pull-secret] (SecretDataNotMatch), force is disabled",
+		},
+	},
+	{
+		name:      "service account patched",
+		force:     true,
+		prepSteps: []step{helperCreateServiceAccountWithoutImagePullSecret(defaultServiceAccountName)},
+		testStep:  processServiceAccountDefault,
+		expected: []string{
+			"Normal ServiceAccountPatched Patched imagePullSecrets [image-pull-secret]",
+		},
+	},
+}
+
+func TestEvents(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer func() {
+		configForce = true
+	}()
+	for _, testCase := range testCasesEvents {
+		configForce = testCase.force
+		configAllServiceAccount = false
+		recorder := record.NewFakeRecorder(10)
+		k8s := &k8sClient{
+			clientset: fake.NewSimpleClientset(),
+			recorder:  recorder,
+		}
+		for _, step := range testCase.prepSteps {
+			if err := step(k8s); err != nil {
+				t.Fatalf("Events(%s) failed during preparation: %v", testCase.name, err)
+			}
+		}
+		if err := testCase.testStep(k8s); err != nil {
+			t.Fatalf("Events(%s) failed during test: %v", testCase.name, err)
+		}
+		close(recorder.Events)
+		var actual []string
+		for event := range recorder.Events {
+			actual = append(actual, event)
+		}
+		if len(actual) != len(testCase.expected) {
+			t.Errorf("Events(%s) gives %v, expects %v", testCase.name, actual, testCase.expected)
+			continue
+		}
+		for i := range actual {
+			if actual[i] != testCase.expected[i] {
+				t.Errorf("Events(%s) gives %q, expects %q", testCase.name, actual[i], testCase.expected[i])
+			}
+		}
+	}
+}
+
+func TestRecordEventWithoutRecorder(t *testing.T) {
+	k8s := &k8sClient{clientset: fake.NewSimpleClientset()}
+	k8s.recordSecretEvent(&corev1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: corev1.NamespaceDefault},
+	}, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: configSecretName, Namespace: corev1.NamespaceDefault},
+	}, corev1.EventTypeNormal, eventReasonSecretCreated, "Created secret [%s]", configSecretName)
+}
+
+func TestEventRecorderFlush(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	clientset := fake.NewSimpleClientset()
+	// the fake clientset cannot create events in the namespace of their object
+	// through the cluster wide sink
+	clientset.PrependReactor("create", "events", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, action.(k8stesting.CreateAction).GetObject(), nil
+	})
+	clientset.PrependReactor("patch", "events", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, &corev1.Event{}, nil
+	})
+	recorder := newEventRecorder(clientset)
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: configSecretName, Namespace: "team-a"},
+	}
+	// the second event is aggregated into the first one
+	for i := 0; i < 2; i++ {
+		recorder.Eventf(secret, corev1.EventTypeNormal, eventReasonSecretDeleted, "Deleted secret [%s] on uninstall", configSecretName)
+	}
+	recorder.flush(5 * time.Second)
+
+	var writes []string
+	for _, action := range clientset.Actions() {
+		writes = append(writes, action.GetVerb()+" "+action.GetResource().Resource)
+	}
+	if expected := []string{"create events", "patch events"}; !reflect.DeepEqual(writes, expected) {
+		t.Errorf("flush should wait until the events are written, got %v, expects %v", writes, expected)
+	}
+}
+
+func TestRecordSecretEventOnNamespace(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	clientset := fake.NewSimpleClientset()
+	var involved []corev1.ObjectReference
+	clientset.PrependReactor("create", "events", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		event := action.(k8stesting.CreateAction).GetObject().(*corev1.Event)
+		involved = append(involved, event.InvolvedObject)
+		return true, event, nil
+	})
+	recorder := newEventRecorder(clientset)
+	k8s := &k8sClient{clientset: clientset, recorder: recorder}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", UID: "team-a-uid"}}
+	k8s.recordSecretEvent(ns, &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: configSecretName, Namespace: "team-a", UID: "secret-uid"},
+	}, corev1.EventTypeNormal, eventReasonSecretDeleted, "Deleted secret [%s] on uninstall", configSecretName)
+	recorder.flush(5 * time.Second)
+
+	uids := map[string]types.UID{}
+	for _, ref := range involved {
+		uids[ref.Kind] = ref.UID
+	}
+	if uids["Namespace"] != ns.UID || uids["Secret"] != "secret-uid" {
+		t.Errorf("recordSecretEvent should record events on the secret and its namespace, got %v", involved)
+	}
+}
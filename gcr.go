@@ -0,0 +1,203 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// prefix of the Google credential source specs, `gcr:` for the service
+	// account of the metadata server or `gcr:<path>` for a service account key
+	credentialSourceGCR = "gcr:"
+
+	// username of registry credentials which are OAuth access tokens
+	gcrUsername        = "oauth2accesstoken"
+	gcrScope           = "https://www.googleapis.com/auth/cloud-platform"
+	gcrDefaultTokenURI = "https://oauth2.googleapis.com/token"
+	gcrHTTPTimeout     = 30 * time.Second
+	// lifetime of the tokens requested with a service account key
+	gcrKeyTokenLifetime = time.Hour
+)
+
+// gcrCredentialSource mints OAuth access tokens of a Google service account
+// for Container Registry and Artifact Registry, either from the metadata
+// server or with a service account key, and keeps them until
+// `CONFIG_GCR_REFRESH_BEFORE` ahead of their expiry
+type gcrCredentialSource struct {
+	// keyPath is the service account key file, empty to use the metadata server
+	keyPath     string
+	metadataURL string
+	registries  []string
+	client      *http.Client
+	now         func() time.Time
+
+	token expiringCredential
+}
+
+func newGCRCredentialSource(keyPath string) (*gcrCredentialSource, error) {
+	var registries []string
+	for _, registry := range strings.Split(configGCRRegistries, ",") {
+		if registry = strings.TrimSpace(registry); registry != "" {
+			registries = append(registries, registry)
+		}
+	}
+	if len(registries) == 0 {
+		return nil, fmt.Errorf("No registry is configured in `gcr-registries`")
+	}
+	if _, err := url.Parse(configGCPMetadataURL); err != nil {
+		return nil, fmt.Errorf("Invalid metadata server URL [%s]: %v", configGCPMetadataURL, err)
+	}
+	return &gcrCredentialSource{
+		keyPath:     keyPath,
+		metadataURL: strings.TrimSuffix(configGCPMetadataURL, "/"),
+		registries:  registries,
+		client:      &http.Client{Timeout: gcrHTTPTimeout},
+		now:         time.Now,
+	}, nil
+}
+
+func (s *gcrCredentialSource) DockerConfigJSON() (string, error) {
+	return s.token.get(s.now(), configGCRRefreshBefore, func() (string, time.Time, error) {
+		var token gcrAccessToken
+		var err error
+		if s.keyPath == "" {
+			token, err = s.metadataToken()
+		} else {
+			token, err = s.keyToken()
+		}
+		if err != nil {
+			return "", time.Time{}, err
+		}
+		dockerConfigJSON, err := registriesDockerConfigJSON(s.registries, gcrUsername, token.AccessToken)
+		return dockerConfigJSON, s.now().Add(time.Duration(token.ExpiresIn) * time.Second), err
+	})
+}
+
+type gcrAccessToken struct {
+	AccessToken string `json:"access_token"`
+	ExpiresIn   int64  `json:"expires_in"`
+}
+
+// metadataToken gets an access token of the service account attached to the
+// node or, with workload identity, to the pod
+func (s *gcrCredentialSource) metadataToken() (gcrAccessToken, error) {
+	req, err := http.NewRequest(http.MethodGet, s.metadataURL+"/computeMetadata/v1/instance/service-accounts/default/token", nil)
+	if err != nil {
+		return gcrAccessToken{}, err
+	}
+	req.Header.Set("Metadata-Flavor", "Google")
+	return s.doTokenRequest(req)
+}
+
+type gcrServiceAccountKey struct {
+	ClientEmail  string `json:"client_email"`
+	PrivateKey   string `json:"private_key"`
+	PrivateKeyID string `json:"private_key_id"`
+	TokenURI     string `json:"token_uri"`
+}
+
+// keyToken exchanges a JWT signed with the service account key for an access
+// token. The key file is read every time, so that a rotated key is picked up.
+func (s *gcrCredentialSource) keyToken() (gcrAccessToken, error) {
+	b, err := ioutil.ReadFile(s.keyPath)
+	if err != nil {
+		return gcrAccessToken{}, fmt.Errorf("Failed to read service account key: %v", err)
+	}
+	var key gcrServiceAccountKey
+	if err := json.Unmarshal(b, &key); err != nil {
+		return gcrAccessToken{}, fmt.Errorf("Failed to parse service account key [%s]: %v", s.keyPath, err)
+	}
+	if key.TokenURI == "" {
+		key.TokenURI = gcrDefaultTokenURI
+	}
+	assertion, err := gcrSignedJWT(key, s.now())
+	if err != nil {
+		return gcrAccessToken{}, err
+	}
+	form := url.Values{
+		"grant_type": {"urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		"assertion":  {assertion},
+	}
+	req, err := http.NewRequest(http.MethodPost, key.TokenURI, strings.NewReader(form.Encode()))
+	if err != nil {
+		return gcrAccessToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return s.doTokenRequest(req)
+}
+
+func (s *gcrCredentialSource) doTokenRequest(req *http.Request) (gcrAccessToken, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return gcrAccessToken{}, fmt.Errorf("Failed to get Google access token: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return gcrAccessToken{}, fmt.Errorf("Failed to get Google access token: %v", err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return gcrAccessToken{}, fmt.Errorf("Failed to get Google access token: %s %s", resp.Status, body)
+	}
+	var token gcrAccessToken
+	if err := json.Unmarshal(body, &token); err != nil {
+		return gcrAccessToken{}, fmt.Errorf("Failed to parse Google access token: %v", err)
+	}
+	if token.AccessToken == "" {
+		return gcrAccessToken{}, fmt.Errorf("Google returned no access token")
+	}
+	return token, nil
+}
+
+// gcrSignedJWT returns the JWT asserting the identity of a service account,
+// signed with RS256 by its private key
+func gcrSignedJWT(key gcrServiceAccountKey, now time.Time) (string, error) {
+	block, _ := pem.Decode([]byte(key.PrivateKey))
+	if block == nil {
+		return "", fmt.Errorf("Invalid private key of service account [%s]", key.ClientEmail)
+	}
+	var privateKey *rsa.PrivateKey
+	if parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes); err == nil {
+		rsaKey, ok := parsed.(*rsa.PrivateKey)
+		if !ok {
+			return "", fmt.Errorf("Private key of service account [%s] is not an RSA key", key.ClientEmail)
+		}
+		privateKey = rsaKey
+	} else if privateKey, err = x509.ParsePKCS1PrivateKey(block.Bytes); err != nil {
+		return "", fmt.Errorf("Invalid private key of service account [%s]: %v", key.ClientEmail, err)
+	}
+
+	header, err := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": key.PrivateKeyID})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"iss":   key.ClientEmail,
+		"scope": gcrScope,
+		"aud":   key.TokenURI,
+		"iat":   now.Unix(),
+		"exp":   now.Add(gcrKeyTokenLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, privateKey, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("Failed to sign with the key of service account [%s]: %v", key.ClientEmail, err)
+	}
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
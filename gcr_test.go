@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestGCRCredentialSourceMetadata(t *testing.T) {
+	calls := 0
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/computeMetadata/v1/instance/service-accounts/default/token" || r.Header.Get("Metadata-Flavor") != "Google" {
+			http.Error(w, "unexpected request", http.StatusForbidden)
+			return
+		}
+		calls++
+		fmt.Fprintf(w, `{"access_token":"token-%d","expires_in":3599,"token_type":"Bearer"}`, calls)
+	}))
+	defer metadata.Close()
+
+	configGCPMetadataURL, configGCRRegistries = metadata.URL, "gcr.io, europe-docker.pkg.dev"
+	defer func() { configGCPMetadataURL, configGCRRegistries = "http://metadata.google.internal", "gcr.io" }()
+	source, err := newGCRCredentialSource("")
+	if err != nil {
+		t.Fatalf("newGCRCredentialSource has error %v", err)
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := now
+	source.now = func() time.Time { return clock }
+
+	actual, err := source.DockerConfigJSON()
+	if err != nil {
+		t.Fatalf("GCR credential source has error %v", err)
+	}
+	expected, _ := registriesDockerConfigJSON([]string{"gcr.io", "europe-docker.pkg.dev"}, gcrUsername, "token-1")
+	if actual != expected {
+		t.Errorf("GCR credential source expects %s but got %s", expected, actual)
+	}
+
+	// the token is reused until the refresh point ahead of its expiry
+	clock = now.Add(45 * time.Minute)
+	if actual, _ := source.DockerConfigJSON(); actual != expected || calls != 1 {
+		t.Errorf("GCR credential source expects the token to be reused, got %d calls", calls)
+	}
+	clock = now.Add(55 * time.Minute)
+	if actual, _ := source.DockerConfigJSON(); !strings.Contains(actual, base64.StdEncoding.EncodeToString([]byte(gcrUsername+":token-2"))) {
+		t.Errorf("GCR credential source expects a new token ahead of expiry, got %s", actual)
+	}
+}
+
+func TestGCRCredentialSourceKey(t *testing.T) {
+	privateKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tokenURI string
+	oauth := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.FormValue("grant_type") != "urn:ietf:params:oauth:grant-type:jwt-bearer" {
+			http.Error(w, `{"error":"unsupported_grant_type"}`, http.StatusBadRequest)
+			return
+		}
+		parts := strings.Split(r.FormValue("assertion"), ".")
+		if len(parts) != 3 {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		if err := rsa.VerifyPKCS1v15(&privateKey.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			http.Error(w, `{"error":"invalid_grant","error_description":"Invalid JWT Signature."}`, http.StatusBadRequest)
+			return
+		}
+		claimsJSON, _ := base64.RawURLEncoding.DecodeString(parts[1])
+		var claims map[string]interface{}
+		json.Unmarshal(claimsJSON, &claims)
+		if claims["iss"] != "patcher@project.iam.gserviceaccount.com" || claims["aud"] != tokenURI || claims["scope"] != gcrScope {
+			http.Error(w, `{"error":"invalid_grant"}`, http.StatusBadRequest)
+			return
+		}
+		w.Write([]byte(`{"access_token":"key-token","expires_in":3599,"token_type":"Bearer"}`))
+	}))
+	defer oauth.Close()
+	tokenURI = oauth.URL + "/token"
+
+	dir, err := ioutil.TempDir("", "imagepullsecret-patcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	keyPath := filepath.Join(dir, "key.json")
+	key, _ := json.Marshal(map[string]string{
+		"type":           "service_account",
+		"client_email":   "patcher@project.iam.gserviceaccount.com",
+		"private_key_id": "key-id",
+		"private_key":    string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		"token_uri":      tokenURI,
+	})
+	if err := ioutil.WriteFile(keyPath, key, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	source, err := newGCRCredentialSource(keyPath)
+	if err != nil {
+		t.Fatalf("newGCRCredentialSource has error %v", err)
+	}
+	actual, err := source.DockerConfigJSON()
+	if err != nil {
+		t.Fatalf("GCR credential source has error %v", err)
+	}
+	expected, _ := registriesDockerConfigJSON([]string{"gcr.io"}, gcrUsername, "key-token")
+	if actual != expected {
+		t.Errorf("GCR credential source expects %s but got %s", expected, actual)
+	}
+}
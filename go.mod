@@ -3,6 +3,8 @@ module github.com/titansoft-pte-ltd/imagepullsecret-patcher
 go 1.13
 
 require (
+	github.com/fsnotify/fsnotify v1.4.7
+	github.com/prometheus/client_golang v1.2.1
 	github.com/sirupsen/logrus v1.4.2
 	k8s.io/api v0.17.0
 	k8s.io/apimachinery v0.17.0
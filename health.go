@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// healthState tracks the progress of the controller for `/healthz` and `/readyz`
+type healthState struct {
+	lock sync.RWMutex
+	// whether the controller is running, false while standing by for the
+	// leader election
+	active bool
+	// when the workers started reconciling
+	started           time.Time
+	credentialsLoaded bool
+	// when the last full sync finished, with or without errors
+	lastSync time.Time
+}
+
+var controllerHealth = &healthState{}
+
+func (h *healthState) setActive() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.active = true
+}
+
+func (h *healthState) setStarted(t time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.started = t
+}
+
+func (h *healthState) setCredentialsLoaded() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.credentialsLoaded = true
+}
+
+func (h *healthState) setSynced(t time.Time) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.lastSync = t
+}
+
+// ready checks that the credentials were loaded and a full sync has completed.
+// A standby replica is always ready, so that it does not block rollouts.
+func (h *healthState) ready() error {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if !h.active {
+		return nil
+	}
+	if !h.credentialsLoaded {
+		return fmt.Errorf("credentials are not loaded")
+	}
+	if h.lastSync.IsZero() {
+		return fmt.Errorf("no full sync has completed")
+	}
+	return nil
+}
+
+// alive checks that a full sync has finished within timeout, counting from
+// the start of the workers until the first sync
+func (h *healthState) alive(now time.Time, timeout time.Duration) error {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if !h.active || h.started.IsZero() {
+		return nil
+	}
+	last := h.lastSync
+	if last.IsZero() {
+		last = h.started
+	}
+	if since := now.Sub(last); since > timeout {
+		return fmt.Errorf("no full sync has finished for %v", since.Round(time.Second))
+	}
+	return nil
+}
+
+// healthHandler serves the result of a check as a probe endpoint
+func healthHandler(check func() error) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		if err := check(); err != nil {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	}
+}
+
+// livenessTimeout is the duration without a finished full sync after which
+// the patcher is considered hung
+func livenessTimeout() time.Duration {
+	return time.Duration(configLivenessLoopMultiple) * configLoopDuration
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+var testNow = time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+
+var testCasesHealthState = []struct {
+	name          string
+	state         *healthState
+	expectedReady bool
+	expectedAlive bool
+}{
+	{
+		name:          "standby",
+		state:         &healthState{},
+		expectedReady: true,
+		expectedAlive: true,
+	},
+	{
+		name:          "loading credentials",
+		state:         &healthState{active: true},
+		expectedReady: false,
+		expectedAlive: true,
+	},
+	{
+		name:          "credentials not loaded",
+		state:         &healthState{active: true, started: testNow.Add(-time.Second)},
+		expectedReady: false,
+		expectedAlive: true,
+	},
+	{
+		name:          "no full sync yet",
+		state:         &healthState{active: true, started: testNow.Add(-time.Second), credentialsLoaded: true},
+		expectedReady: false,
+		expectedAlive: true,
+	},
+	{
+		name:          "no full sync since start",
+		state:         &healthState{active: true, started: testNow.Add(-time.Hour), credentialsLoaded: true},
+		expectedReady: false,
+		expectedAlive: false,
+	},
+	{
+		name:          "synced recently",
+		state:         &healthState{active: true, started: testNow.Add(-time.Hour), credentialsLoaded: true, lastSync: testNow.Add(-time.Second)},
+		expectedReady: true,
+		expectedAlive: true,
+	},
+	{
+		name:          "hung after sync",
+		state:         &healthState{active: true, started: testNow.Add(-time.Hour), credentialsLoaded: true, lastSync: testNow.Add(-10 * time.Minute)},
+		expectedReady: true,
+		expectedAlive: false,
+	},
+}
+
+func TestHealthState(t *testing.T) {
+	for _, testCase := range testCasesHealthState {
+		if ready := testCase.state.ready() == nil; ready != testCase.expectedReady {
+			t.Errorf("ready(%s) gives %v, expects %v", testCase.name, ready, testCase.expectedReady)
+		}
+		if alive := testCase.state.alive(testNow, time.Minute) == nil; alive != testCase.expectedAlive {
+			t.Errorf("alive(%s) gives %v, expects %v", testCase.name, alive, testCase.expectedAlive)
+		}
+	}
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	defer func() {
+		controllerHealth = &healthState{}
+	}()
+	controllerHealth = &healthState{active: true, started: time.Now(), credentialsLoaded: true}
+	server := httptest.NewServer(newHTTPHandler())
+	defer server.Close()
+
+	for _, step := range []struct {
+		path     string
+		expected int
+	}{
+		{path: "/healthz", expected: http.StatusOK},
+		{path: "/readyz", expected: http.StatusServiceUnavailable},
+	} {
+		resp, err := server.Client().Get(server.URL + step.path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != step.expected {
+			t.Errorf("GET %s gives %d, expects %d", step.path, resp.StatusCode, step.expected)
+		}
+	}
+
+	controllerHealth.setSynced(time.Now())
+	resp, err := server.Client().Get(server.URL + "/readyz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Errorf("GET /readyz after a full sync gives %d, expects %d", resp.StatusCode, http.StatusOK)
+	}
+}
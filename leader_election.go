@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"os"
+	"sync"
+
+	log "github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+// leaderElectionIdentity returns the identity of this replica in the lease,
+// which is the pod name when running in a cluster
+func leaderElectionIdentity() (string, error) {
+	if name, ok := os.LookupEnv("POD_NAME"); ok && name != "" {
+		return name, nil
+	}
+	return os.Hostname()
+}
+
+// leaseLost is called when the lease is lost while the patcher is still
+// running, it exits so that the pod restarts as a standby
+var leaseLost = func(identity string) {
+	log.Fatalf("[%s] Lost lease [%s/%s]", identity, configLeaderElectLeaseNamespace, configLeaderElectLeaseName)
+}
+
+// newLeaderElector creates a Lease based leader elector, run is called once
+// the lease is acquired and its context is cancelled when the lease is lost.
+// The lease is not released when the elector stops, as releasing it races with
+// the renewal in this version of client-go, it expires after the lease duration
+// instead.
+func newLeaderElector(k8s *k8sClient, identity string, run func(ctx context.Context), stopped func()) (*leaderelection.LeaderElector, error) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      configLeaderElectLeaseName,
+			Namespace: configLeaderElectLeaseNamespace,
+		},
+		Client: k8s.clientset.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: identity,
+		},
+	}
+	return leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:          lock,
+		LeaseDuration: configLeaderElectLeaseDuration,
+		RenewDeadline: configLeaderElectRenewDeadline,
+		RetryPeriod:   configLeaderElectRetryPeriod,
+		Name:          controllerName,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: run,
+			OnStoppedLeading: stopped,
+			OnNewLeader: func(leader string) {
+				if leader != identity {
+					log.Infof("Current leader is [%s]", leader)
+				}
+			},
+		},
+	})
+}
+
+// runWithLeaderElection blocks until ctx is done, calling run only while this
+// replica holds the lease. Losing the lease exits the process so that the pod
+// restarts as a standby. When ctx is done, the lease keeps being renewed until
+// run has returned, so that the next leader never overlaps with this one.
+func runWithLeaderElection(ctx context.Context, k8s *k8sClient, run func(ctx context.Context)) {
+	identity, err := leaderElectionIdentity()
+	if err != nil {
+		log.Panic(err)
+	}
+	// the elector stops renewing the lease as soon as its context is done,
+	// without waiting for run, so it gets its own context cancelled after run
+	// returns
+	leaderCtx, stopLeading := context.WithCancel(context.Background())
+	defer stopLeading()
+	var lock sync.Mutex
+	leading := false
+	runDone := make(chan struct{})
+	go func() {
+		<-ctx.Done()
+		lock.Lock()
+		wait := leading
+		lock.Unlock()
+		if wait {
+			<-runDone
+		}
+		stopLeading()
+	}()
+
+	le, err := newLeaderElector(k8s, identity, func(leaderCtx context.Context) {
+		lock.Lock()
+		if ctx.Err() != nil {
+			lock.Unlock()
+			return
+		}
+		leading = true
+		lock.Unlock()
+		defer close(runDone)
+		log.Infof("[%s] Acquired lease [%s/%s]", identity, configLeaderElectLeaseNamespace, configLeaderElectLeaseName)
+
+		// stop on termination as well as on losing the lease
+		runCtx, cancel := context.WithCancel(leaderCtx)
+		defer cancel()
+		go func() {
+			select {
+			case <-ctx.Done():
+				cancel()
+			case <-runCtx.Done():
+			}
+		}()
+		run(runCtx)
+	}, func() {
+		if ctx.Err() != nil {
+			log.Infof("[%s] Stopped renewing lease [%s/%s]", identity, configLeaderElectLeaseNamespace, configLeaderElectLeaseName)
+			return
+		}
+		leaseLost(identity)
+	})
+	if err != nil {
+		log.Panic(err)
+	}
+	log.Infof("[%s] Waiting to acquire lease [%s/%s]", identity, configLeaderElectLeaseNamespace, configLeaderElectLeaseName)
+	le.Run(leaderCtx)
+}
@@ -0,0 +1,210 @@
+//go:build !race
+// +build !race
+
+// The leader elector of client-go v0.17 abandons a renewal in flight when its
+// context is cancelled or the renew deadline passes, and reads the lease record
+// while the abandoned renewal still writes it. The race detector reports it
+// now and then, so these tests do not run with -race until client-go is
+// upgraded to v0.19 or later.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// helperLeaderElection shortens the lease timings and sets the identity of the
+// replica, and returns a function restoring them
+func helperLeaderElection(identity string) func() {
+	leaseDuration, renewDeadline, retryPeriod := configLeaderElectLeaseDuration, configLeaderElectRenewDeadline, configLeaderElectRetryPeriod
+	podName, podNameSet := os.LookupEnv("POD_NAME")
+	configLeaderElectLeaseDuration = time.Second
+	configLeaderElectRenewDeadline = 500 * time.Millisecond
+	configLeaderElectRetryPeriod = 100 * time.Millisecond
+	os.Setenv("POD_NAME", identity)
+	return func() {
+		configLeaderElectLeaseDuration, configLeaderElectRenewDeadline, configLeaderElectRetryPeriod = leaseDuration, renewDeadline, retryPeriod
+		if podNameSet {
+			os.Setenv("POD_NAME", podName)
+		} else {
+			os.Unsetenv("POD_NAME")
+		}
+	}
+}
+
+func TestLeaderElectionHandover(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer helperLeaderElection("replica-a")()
+
+	k8s := &k8sClient{
+		clientset: fake.NewSimpleClientset(),
+	}
+	leading := make(chan string, 2)
+	startReplica := func(identity string) context.CancelFunc {
+		ctx, cancel := context.WithCancel(context.Background())
+		le, err := newLeaderElector(k8s, identity, func(ctx context.Context) {
+			leading <- identity
+			<-ctx.Done()
+		}, func() {})
+		if err != nil {
+			t.Fatalf("newLeaderElector(%s) failed: %v", identity, err)
+		}
+		go le.Run(ctx)
+		return cancel
+	}
+
+	stopA := startReplica("replica-a")
+	select {
+	case leader := <-leading:
+		if leader != "replica-a" {
+			t.Fatalf("expects replica-a to acquire the lease, got %s", leader)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replica-a did not acquire the lease")
+	}
+
+	stopB := startReplica("replica-b")
+	defer stopB()
+	select {
+	case leader := <-leading:
+		t.Fatalf("expects a single leader, but %s also acquired the lease", leader)
+	case <-time.After(2 * configLeaderElectLeaseDuration):
+	}
+
+	// the leader steps down, the standby should take over once the lease expires
+	stopA()
+	select {
+	case leader := <-leading:
+		if leader != "replica-b" {
+			t.Fatalf("expects replica-b to take over the lease, got %s", leader)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("replica-b did not take over the lease")
+	}
+}
+
+func TestRunWithLeaderElectionWaitsForRun(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer helperLeaderElection("replica-a")()
+
+	clientset := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan struct{})
+	finish := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runWithLeaderElection(ctx, &k8sClient{clientset: clientset}, func(ctx context.Context) {
+			close(started)
+			<-ctx.Done()
+			<-finish
+		})
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run was not called after acquiring the lease")
+	}
+
+	// run is still finishing its work after the patcher is stopped
+	cancel()
+	lease, err := clientset.CoordinationV1().Leases(configLeaderElectLeaseNamespace).Get(configLeaderElectLeaseName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-done:
+		t.Fatal("runWithLeaderElection should not return before run")
+	case <-time.After(2 * configLeaderElectLeaseDuration):
+	}
+	renewed, err := clientset.CoordinationV1().Leases(configLeaderElectLeaseNamespace).Get(configLeaderElectLeaseName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !renewed.Spec.RenewTime.After(lease.Spec.RenewTime.Time) {
+		t.Errorf("lease should keep being renewed until run returns, renewed at %v", renewed.Spec.RenewTime)
+	}
+
+	close(finish)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runWithLeaderElection did not return after run")
+	}
+}
+
+func TestRunWithLeaderElectionLostLease(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer helperLeaderElection("replica-a")()
+	lost := make(chan string, 1)
+	defer func(f func(string)) {
+		leaseLost = f
+	}(leaseLost)
+	leaseLost = func(identity string) {
+		lost <- identity
+	}
+
+	clientset := fake.NewSimpleClientset()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	started := make(chan struct{})
+	stopped := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		runWithLeaderElection(ctx, &k8sClient{clientset: clientset}, func(ctx context.Context) {
+			close(started)
+			<-ctx.Done()
+			close(stopped)
+		})
+	}()
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("run was not called after acquiring the lease")
+	}
+
+	// another replica takes the lease over, the write is repeated as it may be
+	// overwritten by a renewal in flight
+	leases := clientset.CoordinationV1().Leases(configLeaderElectLeaseNamespace)
+	timeout := time.After(5 * time.Second)
+	for {
+		lease, err := leases.Get(configLeaderElectLeaseName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		holder := "replica-b"
+		now := metav1.NewMicroTime(time.Now())
+		lease.Spec.HolderIdentity = &holder
+		lease.Spec.AcquireTime = &now
+		lease.Spec.RenewTime = &now
+		if _, err := leases.Update(lease); err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case identity := <-lost:
+			if identity != "replica-a" {
+				t.Errorf("expects replica-a to lose the lease, got %s", identity)
+			}
+			select {
+			case <-stopped:
+			case <-time.After(5 * time.Second):
+				t.Errorf("run should be stopped when the lease is lost")
+			}
+			<-done
+			return
+		case <-timeout:
+			t.Fatal("losing the lease should be fatal")
+		case <-time.After(configLeaderElectRetryPeriod):
+		}
+	}
+}
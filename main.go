@@ -1,44 +1,155 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path"
 	"strings"
+	"syscall"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
 	"k8s.io/apimachinery/pkg/types"
+	utilerrors "k8s.io/apimachinery/pkg/util/errors"
+	"k8s.io/apimachinery/pkg/util/validation"
 	"k8s.io/client-go/kubernetes"
+	corelisters "k8s.io/client-go/listers/core/v1"
 	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/client-go/util/retry"
 )
 
 var (
 	// Config
-	configForce                bool          = true
-	configDebug                bool          = false
-	configManagedOnly          bool          = false
-	configRunOnce              bool          = false
-	configAllServiceAccount    bool          = false
-	configDockerconfigjson     string        = ""
-	configDockerConfigJSONPath string        = ""
-	configSecretName           string        = "image-pull-secret" // default to image-pull-secret
-	configExcludedNamespaces   string        = ""
-	configServiceAccounts      string        = defaultServiceAccountName
-	configLoopDuration         time.Duration = 10 * time.Second
-
-	dockerConfigJSON string
+	configForce                  bool          = true
+	configDebug                  bool          = false
+	configManagedOnly            bool          = false
+	configRunOnce                bool          = false
+	configAllServiceAccount      bool          = false
+	configDockerconfigjson       string        = ""
+	configDockerConfigJSONPath   string        = ""
+	configSecretName             string        = "image-pull-secret" // default to image-pull-secret
+	configSecrets                string        = ""
+	configInstance               string        = defaultInstance
+	configSourceSecret           string        = ""
+	configCredentialSources      string        = ""
+	configECREndpoint            string        = ""
+	configECRRefreshBefore       time.Duration = time.Hour
+	configAWSSTSEndpoint         string        = "https://sts.amazonaws.com"
+	configGCRRegistries          string        = "gcr.io"
+	configGCRRefreshBefore       time.Duration = 10 * time.Minute
+	configGCPMetadataURL         string        = "http://metadata.google.internal"
+	configACRRefreshBefore       time.Duration = 30 * time.Minute
+	configAzureAuthorityHost     string        = "https://login.microsoftonline.com"
+	configAzureIMDSURL           string        = "http://169.254.169.254"
+	configVaultAddr              string        = ""
+	configVaultAuthRole          string        = ""
+	configVaultAuthMount         string        = "kubernetes"
+	configVaultTokenPath         string        = ""
+	configVaultFields            string        = "registry,username,password"
+	configVaultRefreshInterval   time.Duration = 5 * time.Minute
+	configExcludedNamespaces     string        = ""
+	configCleanupExcluded        bool          = false
+	configIncludedNamespaces     string        = ""
+	configNamespaceSelector      string        = ""
+	configServiceAccountSelector string        = ""
+	configServiceAccounts        string        = defaultServiceAccountName
+	configLoopDuration           time.Duration = 10 * time.Second
+	configDryRun                 bool          = false
+	configDryRunOutput           string        = dryRunOutputText
+	configHTTPAddress            string        = ":8080"
+	configLivenessLoopMultiple   int           = 5
+
+	configLeaderElect               bool          = false
+	configLeaderElectLeaseName      string        = "imagepullsecret-patcher"
+	configLeaderElectLeaseNamespace string        = "imagepullsecret-patcher"
+	configLeaderElectLeaseDuration  time.Duration = 15 * time.Second
+	configLeaderElectRenewDeadline  time.Duration = 10 * time.Second
+	configLeaderElectRetryPeriod    time.Duration = 2 * time.Second
+
+	managedSecrets []*managedSecret
+	// credentials selected by namespaces instead of the default ones
+	alternativeCredentials []*managedSecret
+	namespaceSelector      labels.Selector = labels.Everything()
+	// nil unless `CONFIG_SERVICEACCOUNT_SELECTOR` is set
+	serviceAccountSelector labels.Selector
+	// parsed from `CONFIG_EXCLUDED_NAMESPACES` and `CONFIG_INCLUDED_NAMESPACES`
+	excludedNamespaces namespacePatterns
+	includedNamespaces namespacePatterns
 )
 
 const (
-	annotationImagepullsecretPatcherExclude = "k8s.titansoft.com/imagepullsecret-patcher-exclude"
+	annotationImagepullsecretPatcherExclude          = "k8s.titansoft.com/imagepullsecret-patcher-exclude"
+	annotationImagepullsecretPatcherInclude          = "k8s.titansoft.com/imagepullsecret-patcher-include"
+	annotationImagepullsecretPatcherSecrets          = "k8s.titansoft.com/imagepullsecret-patcher-secrets"
+	annotationImagepullsecretPatcherCredentialSource = "k8s.titansoft.com/imagepullsecret-patcher-credential-source"
 )
 
 type k8sClient struct {
 	clientset kubernetes.Interface
+	recorder  record.EventRecorder
+
+	// listers of the controller informers, the reads go to the API server
+	// when they are not set, e.g. in runonce mode. The secret lister only
+	// holds the secrets labeled with `labelSecretName`.
+	secretLister         corelisters.SecretLister
+	serviceAccountLister corelisters.ServiceAccountLister
+}
+
+// getSecret reads a secret from the informer cache, or from the API server
+// without one. The returned secret must not be modified.
+func (k8s *k8sClient) getSecret(namespace, name string) (*corev1.Secret, error) {
+	if k8s.secretLister != nil {
+		secret, err := k8s.secretLister.Secrets(namespace).Get(name)
+		// only the labeled managed secrets are cached, a missing secret may be
+		// an unlabeled one
+		if !errors.IsNotFound(err) {
+			return secret, err
+		}
+	}
+	return k8s.clientset.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+}
+
+// listSecrets lists the secrets of a namespace matching a label selector,
+// from the informer cache or from the API server without one. With the cache,
+// only labeled managed secrets are listed.
+func (k8s *k8sClient) listSecrets(namespace string, selector labels.Selector) ([]*corev1.Secret, error) {
+	if k8s.secretLister != nil {
+		return k8s.secretLister.Secrets(namespace).List(selector)
+	}
+	list, err := k8s.clientset.CoreV1().Secrets(namespace).List(metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, err
+	}
+	secrets := make([]*corev1.Secret, 0, len(list.Items))
+	for i := range list.Items {
+		secrets = append(secrets, &list.Items[i])
+	}
+	return secrets, nil
+}
+
+// listServiceAccounts lists the service accounts of a namespace, from the
+// informer cache or from the API server without one
+func (k8s *k8sClient) listServiceAccounts(namespace string) ([]*corev1.ServiceAccount, error) {
+	if k8s.serviceAccountLister != nil {
+		return k8s.serviceAccountLister.ServiceAccounts(namespace).List(labels.Everything())
+	}
+	list, err := k8s.clientset.CoreV1().ServiceAccounts(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, err
+	}
+	sas := make([]*corev1.ServiceAccount, 0, len(list.Items))
+	for i := range list.Items {
+		sas = append(sas, &list.Items[i])
+	}
+	return sas, nil
 }
 
 func main() {
@@ -51,10 +162,54 @@ func main() {
 	flag.StringVar(&configDockerconfigjson, "dockerconfigjson", LookupEnvOrString("CONFIG_DOCKERCONFIGJSON", configDockerconfigjson), "json credential for authenicating container registry, exclusive with `dockerconfigjsonpath`")
 	flag.StringVar(&configDockerConfigJSONPath, "dockerconfigjsonpath", LookupEnvOrString("CONFIG_DOCKERCONFIGJSONPATH", configDockerConfigJSONPath), "path to json file containing credentials for the registry to be distributed, exclusive with `dockerconfigjson`")
 	flag.StringVar(&configSecretName, "secretname", LookupEnvOrString("CONFIG_SECRETNAME", configSecretName), "set name of managed secrets")
-	flag.StringVar(&configExcludedNamespaces, "excluded-namespaces", LookupEnvOrString("CONFIG_EXCLUDED_NAMESPACES", configExcludedNamespaces), "comma-separated namespaces excluded from processing")
-	flag.StringVar(&configServiceAccounts, "serviceaccounts", LookupEnvOrString("CONFIG_SERVICEACCOUNTS", configServiceAccounts), "comma-separated list of serviceaccounts to patch")
-	flag.DurationVar(&configLoopDuration, "loop-duration", LookupEnvOrDuration("CONFIG_LOOP_DURATION", configLoopDuration), "String defining the loop duration")
+	flag.StringVar(&configInstance, "instance", LookupEnvOrString("CONFIG_INSTANCE", configInstance), "name of this deployment recorded on the secrets it creates, distinct for deployments managing different secrets in the same cluster")
+	flag.StringVar(&configSecrets, "secrets", LookupEnvOrString("CONFIG_SECRETS", configSecrets), "comma-separated list of `name=source` pairs of managed secrets, where source is `file:<path>`, `env:<variable>`, `secret:<namespace>/<name>`, `ecr:<region>`, `gcr:[<key path>]`, `acr:<registry host>` or `vault:<mount>/<path>`, exclusive with `secretname`, `dockerconfigjson` and `dockerconfigjsonpath`")
+	flag.StringVar(&configSourceSecret, "source-secret", LookupEnvOrString("CONFIG_SOURCE_SECRET", configSourceSecret), "`namespace/name` of a Secret in the cluster to read the json credential from, exclusive with `dockerconfigjson` and `dockerconfigjsonpath`")
+	flag.StringVar(&configCredentialSources, "credential-sources", LookupEnvOrString("CONFIG_CREDENTIAL_SOURCES", configCredentialSources), "comma-separated list of `name=source` pairs of alternative credentials, which namespaces select with an annotation")
+	flag.StringVar(&configECREndpoint, "ecr-endpoint", LookupEnvOrString("CONFIG_ECR_ENDPOINT", configECREndpoint), "URL of the ECR API used by `ecr:` sources, empty for the regional endpoint")
+	flag.DurationVar(&configECRRefreshBefore, "ecr-refresh-before", LookupEnvOrDuration("CONFIG_ECR_REFRESH_BEFORE", configECRRefreshBefore), "how long before expiry an ECR authorization token is refreshed, should be longer than `loop-duration`")
+	flag.StringVar(&configAWSSTSEndpoint, "aws-sts-endpoint", LookupEnvOrString("CONFIG_AWS_STS_ENDPOINT", configAWSSTSEndpoint), "URL of the STS API used to assume the role of `AWS_ROLE_ARN`")
+	flag.StringVar(&configGCRRegistries, "gcr-registries", LookupEnvOrString("CONFIG_GCR_REGISTRIES", configGCRRegistries), "comma-separated registry hosts given the access tokens of `gcr:` sources, e.g. `gcr.io,europe-docker.pkg.dev`")
+	flag.DurationVar(&configGCRRefreshBefore, "gcr-refresh-before", LookupEnvOrDuration("CONFIG_GCR_REFRESH_BEFORE", configGCRRefreshBefore), "how long before expiry a Google access token is refreshed, should be longer than `loop-duration`")
+	flag.StringVar(&configGCPMetadataURL, "gcp-metadata-url", LookupEnvOrString("CONFIG_GCP_METADATA_URL", configGCPMetadataURL), "base URL of the metadata server used by `gcr:` sources without a key")
+	flag.DurationVar(&configACRRefreshBefore, "acr-refresh-before", LookupEnvOrDuration("CONFIG_ACR_REFRESH_BEFORE", configACRRefreshBefore), "how long before expiry an ACR refresh token is renewed, should be longer than `loop-duration`")
+	flag.StringVar(&configAzureAuthorityHost, "azure-authority-host", LookupEnvOrString("CONFIG_AZURE_AUTHORITY_HOST", configAzureAuthorityHost), "URL of Azure AD used by `acr:` sources with `AZURE_CLIENT_SECRET`")
+	flag.StringVar(&configAzureIMDSURL, "azure-imds-url", LookupEnvOrString("CONFIG_AZURE_IMDS_URL", configAzureIMDSURL), "base URL of the managed identity endpoint used by `acr:` sources without `AZURE_CLIENT_SECRET`")
+	flag.StringVar(&configVaultAddr, "vault-addr", LookupEnvOrString("CONFIG_VAULT_ADDR", configVaultAddr), "URL of Vault used by `vault:` sources, e.g. `https://vault.example.com:8200`")
+	flag.StringVar(&configVaultAuthRole, "vault-auth-role", LookupEnvOrString("CONFIG_VAULT_AUTH_ROLE", configVaultAuthRole), "role to log in to Vault with the Kubernetes auth method, exclusive with `vault-token-path`")
+	flag.StringVar(&configVaultAuthMount, "vault-auth-mount", LookupEnvOrString("CONFIG_VAULT_AUTH_MOUNT", configVaultAuthMount), "path the Kubernetes auth method is mounted at in Vault")
+	flag.StringVar(&configVaultTokenPath, "vault-token-path", LookupEnvOrString("CONFIG_VAULT_TOKEN_PATH", configVaultTokenPath), "path to a file holding a Vault token, read again on every request")
+	flag.StringVar(&configVaultFields, "vault-fields", LookupEnvOrString("CONFIG_VAULT_FIELDS", configVaultFields), "comma-separated names of the registry, username and password fields of the Vault secrets")
+	flag.DurationVar(&configVaultRefreshInterval, "vault-refresh-interval", LookupEnvOrDuration("CONFIG_VAULT_REFRESH_INTERVAL", configVaultRefreshInterval), "how often a Vault secret without a lease is read again")
+	flag.StringVar(&configExcludedNamespaces, "excluded-namespaces", LookupEnvOrString("CONFIG_EXCLUDED_NAMESPACES", configExcludedNamespaces), "comma-separated namespaces excluded from processing, as globs like `kube-*` or regexps like `re:^ci-[0-9]+$`")
+	flag.BoolVar(&configCleanupExcluded, "cleanup-excluded", LookUpEnvOrBool("CONFIG_CLEANUP_EXCLUDED", configCleanupExcluded), "delete the managed secrets from excluded namespaces")
+	flag.StringVar(&configIncludedNamespaces, "included-namespaces", LookupEnvOrString("CONFIG_INCLUDED_NAMESPACES", configIncludedNamespaces), "comma-separated namespaces to process, in the same format as `excluded-namespaces`, empty for all")
+	flag.StringVar(&configNamespaceSelector, "namespace-selector", LookupEnvOrString("CONFIG_NAMESPACE_SELECTOR", configNamespaceSelector), "label selector of the namespaces to process, e.g. `team in (a,b),!sandbox`")
+	flag.StringVar(&configServiceAccounts, "serviceaccounts", LookupEnvOrString("CONFIG_SERVICEACCOUNTS", configServiceAccounts), "comma-separated list of serviceaccounts to patch, as names or globs like `builder-*`")
+	flag.StringVar(&configServiceAccountSelector, "serviceaccount-selector", LookupEnvOrString("CONFIG_SERVICEACCOUNT_SELECTOR", configServiceAccountSelector), "label selector of additional serviceaccounts to patch, e.g. `ci.example.com/runner=true`")
+	flag.DurationVar(&configLoopDuration, "loop-duration", LookupEnvOrDuration("CONFIG_LOOP_DURATION", configLoopDuration), "String defining the resync interval of the informers")
+	flag.BoolVar(&configDryRun, "dry-run", LookUpEnvOrBool("CONFIG_DRY_RUN", configDryRun), "print the changes to all namespaces without making them, then exit")
+	flag.StringVar(&configDryRunOutput, "dry-run-output", LookupEnvOrString("CONFIG_DRY_RUN_OUTPUT", configDryRunOutput), "output format of `dry-run`, either `text` or `json`")
+	flag.StringVar(&configHTTPAddress, "http-address", LookupEnvOrString("CONFIG_HTTP_ADDRESS", configHTTPAddress), "address to serve `/metrics`, `/healthz` and `/readyz` on, empty to disable")
+	flag.IntVar(&configLivenessLoopMultiple, "liveness-loop-multiple", LookupEnvOrInt("CONFIG_LIVENESS_LOOP_MULTIPLE", configLivenessLoopMultiple), "`/healthz` fails when no sync has finished within this multiple of `loop-duration`")
+	flag.BoolVar(&configLeaderElect, "leader-elect", LookUpEnvOrBool("CONFIG_LEADER_ELECT", configLeaderElect), "run leader election so that only one of several replicas reconciles")
+	flag.StringVar(&configLeaderElectLeaseName, "leader-elect-lease-name", LookupEnvOrString("CONFIG_LEADER_ELECT_LEASE_NAME", configLeaderElectLeaseName), "name of the Lease used for leader election")
+	flag.StringVar(&configLeaderElectLeaseNamespace, "leader-elect-lease-namespace", LookupEnvOrString("CONFIG_LEADER_ELECT_LEASE_NAMESPACE", configLeaderElectLeaseNamespace), "namespace of the Lease used for leader election")
+	flag.DurationVar(&configLeaderElectLeaseDuration, "leader-elect-lease-duration", LookupEnvOrDuration("CONFIG_LEADER_ELECT_LEASE_DURATION", configLeaderElectLeaseDuration), "duration that standbys wait before taking over an unrenewed lease")
+	flag.DurationVar(&configLeaderElectRenewDeadline, "leader-elect-renew-deadline", LookupEnvOrDuration("CONFIG_LEADER_ELECT_RENEW_DEADLINE", configLeaderElectRenewDeadline), "duration that the leader retries renewing the lease before giving it up")
+	flag.DurationVar(&configLeaderElectRetryPeriod, "leader-elect-retry-period", LookupEnvOrDuration("CONFIG_LEADER_ELECT_RETRY_PERIOD", configLeaderElectRetryPeriod), "duration between attempts to acquire or renew the lease")
 	flag.Parse()
+	command := flag.Arg(0)
+	switch command {
+	case "":
+	case commandUninstall:
+		uninstallFlags := flag.NewFlagSet(commandUninstall, flag.ExitOnError)
+		uninstallFlags.BoolVar(&configDryRun, "dry-run", configDryRun, "print what would be removed without removing it")
+		uninstallFlags.StringVar(&configInstance, "instance", configInstance, "name of the deployment whose secrets are removed")
+		uninstallFlags.Parse(flag.Args()[1:])
+	default:
+		log.Fatalf("Unknown command [%s], expects `%s`", command, commandUninstall)
+	}
 
 	// setup logrus
 	if configDebug {
@@ -66,6 +221,41 @@ func main() {
 	if configDockerconfigjson != "" && configDockerConfigJSONPath != "" {
 		log.Panic(fmt.Errorf("Cannot specify both `configdockerjson` and `configdockerjsonpath`"))
 	}
+	var err error
+	managedSecrets, err = buildManagedSecrets()
+	if err != nil {
+		log.Panic(err)
+	}
+	alternativeCredentials, err = buildAlternativeCredentials()
+	if err != nil {
+		log.Panic(err)
+	}
+	if errs := validation.IsValidLabelValue(configInstance); len(errs) > 0 {
+		log.Panic(fmt.Errorf("Invalid `instance` [%s]: %s", configInstance, strings.Join(errs, ", ")))
+	}
+	namespaceSelector, err = labels.Parse(configNamespaceSelector)
+	if err != nil {
+		log.Panic(fmt.Errorf("Invalid `namespace-selector`: %v", err))
+	}
+	for _, glob := range strings.Split(configServiceAccounts, ",") {
+		if _, err := path.Match(glob, ""); err != nil {
+			log.Panic(fmt.Errorf("Invalid `serviceaccounts` glob [%s]: %v", glob, err))
+		}
+	}
+	if configServiceAccountSelector != "" {
+		serviceAccountSelector, err = labels.Parse(configServiceAccountSelector)
+		if err != nil {
+			log.Panic(fmt.Errorf("Invalid `serviceaccount-selector`: %v", err))
+		}
+	}
+	excludedNamespaces, err = parseNamespacePatterns(configExcludedNamespaces)
+	if err != nil {
+		log.Panic(fmt.Errorf("Invalid `excluded-namespaces`: %v", err))
+	}
+	includedNamespaces, err = parseNamespacePatterns(configIncludedNamespaces)
+	if err != nil {
+		log.Panic(fmt.Errorf("Invalid `included-namespaces`: %v", err))
+	}
 
 	// create k8s clientset from in-cluster config
 	config, err := rest.InClusterConfig()
@@ -76,142 +266,527 @@ func main() {
 	if err != nil {
 		log.Panic(err)
 	}
+	recorder := newEventRecorder(clientset)
 	k8s := &k8sClient{
 		clientset: clientset,
+		recorder:  recorder,
 	}
+	connectSecretCredentialSources(clientset)
 
-	for {
-		log.Debug("Loop started")
-		loop(k8s)
-		if configRunOnce {
-			log.Info("Exiting after single loop per `CONFIG_RUNONCE`")
-			os.Exit(0)
+	// the events are written asynchronously, and would be lost on exit
+	if command == commandUninstall {
+		err := uninstall(k8s, os.Stdout, configDryRun)
+		recorder.flush(eventFlushTimeout)
+		if err != nil {
+			log.Fatal(err)
 		}
-		time.Sleep(configLoopDuration)
+		os.Exit(0)
 	}
-}
 
-func loop(k8s *k8sClient) {
-	var err error
+	if configDryRun {
+		if err := dryRun(k8s, os.Stdout, configDryRunOutput); err != nil {
+			log.Fatal(err)
+		}
+		os.Exit(0)
+	}
 
-	// Populate secret value to set
-	dockerConfigJSON, err = getDockerConfigJSON()
+	if configRunOnce {
+		err := loop(k8s)
+		recorder.flush(eventFlushTimeout)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Info("Exiting after single loop per `CONFIG_RUNONCE`")
+		os.Exit(0)
+	}
+
+	serveHTTP(configHTTPAddress)
+	defer recorder.flush(eventFlushTimeout)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		sigCh := make(chan os.Signal, 1)
+		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
+		<-sigCh
+		log.Info("Received termination signal, shutting down")
+		cancel()
+	}()
+
+	run := func(ctx context.Context) {
+		if err := newController(k8s, configLoopDuration).Run(controllerWorkers, ctx.Done()); err != nil {
+			log.Panic(err)
+		}
+	}
+	if configLeaderElect {
+		runWithLeaderElection(ctx, k8s, run)
+		return
+	}
+	run(ctx)
+}
+
+// loop processes every namespace once, it is used when `CONFIG_RUNONCE` is set.
+// Transient errors are retried with backoff, and a secret whose credentials
+// cannot be loaded is skipped while the others are processed. It returns an
+// error when any credential could not be loaded or any namespace failed, so
+// that the exit code reflects the outcome.
+func loop(k8s *k8sClient) error {
+	// Populate secret values to set
+	err := retryTransient(transientErrorBackoff, "Loading credentials", func() error {
+		_, err := refreshManagedSecrets()
+		return err
+	})
 	if err != nil {
-		log.Panic(err)
+		log.Error(err)
 	}
 
 	// get all namespaces
-	namespaces, err := k8s.clientset.CoreV1().Namespaces().List(metav1.ListOptions{})
+	var namespaces *corev1.NamespaceList
+	err = retryTransient(transientErrorBackoff, "Listing namespaces", func() error {
+		var err error
+		namespaces, err = k8s.clientset.CoreV1().Namespaces().List(namespaceListOptions())
+		if err != nil {
+			metricErrors.WithLabelValues(operationList).Inc()
+		}
+		return err
+	})
 	if err != nil {
-		log.Panic(err)
+		return fmt.Errorf("Failed to list namespaces: %v", err)
 	}
 	log.Debugf("Got %d namespaces", len(namespaces.Items))
 
+	failed := 0
 	for _, ns := range namespaces.Items {
-		namespace := ns.Name
-		if namespaceIsExcluded(ns) {
-			log.Infof("[%s] Namespace skipped", namespace)
-			continue
+		if err := processNamespace(k8s, ns); err != nil {
+			log.Error(err)
+			failed++
 		}
-		log.Debugf("[%s] Start processing", namespace)
-		// for each namespace, make sure the dockerconfig secret exists
-		err = processSecret(k8s, namespace)
+	}
+
+	var errs []error
+	if !managedSecretsLoaded() {
+		errs = append(errs, fmt.Errorf("Failed to load credentials, the secrets without them were skipped"))
+	}
+	if failed > 0 {
+		errs = append(errs, fmt.Errorf("Failed to process %d of %d namespaces", failed, len(namespaces.Items)))
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// processNamespace makes sure the managed secrets exist in a namespace and
+// are patched to its service accounts
+func processNamespace(k8s *k8sClient, ns corev1.Namespace) error {
+	namespace := ns.Name
+	if namespaceIsExcluded(ns) {
+		log.Infof("[%s] Namespace skipped", namespace)
+		metricNamespacesSkipped.Inc()
+		return releaseNamespace(k8s, &ns)
+	}
+	log.Debugf("[%s] Start processing", namespace)
+	// for each namespace, make sure the managed secrets exist
+	var secretNames []string
+	var errs []error
+	for _, ms := range managedSecrets {
+		dockerConfigJSON, err := namespaceDockerConfigJSON(ns, ms)
 		if err != nil {
-			// if has error in processing secret, should skip processing service account
-			log.Error(err)
+			errs = append(errs, fmt.Errorf("[%s] %v", namespace, err))
 			continue
 		}
-		// get default service account, and patch image pull secret if not exist
-		err = processServiceAccount(k8s, namespace)
-		if err != nil {
-			log.Error(err)
+		if err := processSecret(k8s, &ns, ms.name, dockerConfigJSON); err != nil {
+			// if has error in processing secret, should skip patching it to service accounts
+			errs = append(errs, err)
+			continue
+		}
+		secretNames = append(secretNames, ms.name)
+	}
+	// get service accounts, and patch image pull secrets if not exist
+	if len(secretNames) > 0 {
+		if err := processServiceAccount(k8s, namespace, secretNames); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	// remove the secrets which are no longer configured, once the configured
+	// ones are in place
+	if len(errs) == 0 {
+		if err := migrateSecrets(k8s, &ns); err != nil {
+			errs = append(errs, err)
 		}
 	}
+	return utilerrors.NewAggregate(errs)
 }
 
+// namespaceListOptions returns the options to list and watch the namespaces
+// selected by `CONFIG_NAMESPACE_SELECTOR`
+func namespaceListOptions() metav1.ListOptions {
+	return metav1.ListOptions{LabelSelector: namespaceSelector.String()}
+}
+
+// namespaceIsSelected checks if a namespace matches `CONFIG_NAMESPACE_SELECTOR`
+func namespaceIsSelected(ns *corev1.Namespace) bool {
+	return namespaceSelector.Matches(labels.Set(ns.Labels))
+}
+
+// namespaceIsExcluded checks the exclude annotation, and whether the namespace
+// is outside `CONFIG_INCLUDED_NAMESPACES` or inside `CONFIG_EXCLUDED_NAMESPACES`
 func namespaceIsExcluded(ns corev1.Namespace) bool {
 	v, ok := ns.Annotations[annotationImagepullsecretPatcherExclude]
 	if ok && v == "true" {
 		return true
 	}
-	for _, ex := range strings.Split(configExcludedNamespaces, ",") {
-		if ex == ns.Name {
-			return true
-		}
+	if len(includedNamespaces) > 0 && !includedNamespaces.matches(ns.Name) {
+		return true
 	}
-	return false
+	return excludedNamespaces.matches(ns.Name)
 }
 
-func processSecret(k8s *k8sClient, namespace string) error {
-	secret, err := k8s.clientset.CoreV1().Secrets(namespace).Get(configSecretName, metav1.GetOptions{})
+func processSecret(k8s *k8sClient, ns *corev1.Namespace, secretName, dockerConfigJSON string) error {
+	namespace := ns.Name
+	secret, err := k8s.getSecret(namespace, secretName)
 	if errors.IsNotFound(err) {
-		_, err := k8s.clientset.CoreV1().Secrets(namespace).Create(dockerconfigSecret(namespace))
+		secret = nil
+	} else if err != nil {
+		metricErrors.WithLabelValues(operationGet).Inc()
+		return fmt.Errorf("[%s] Failed to GET secret [%s]: %v", namespace, secretName, err)
+	}
+	plan := planSecret(secretName, secret, dockerConfigJSON)
+	// writes are counted once they succeed, failures are counted as errors
+	countSecret := func() {
+		metricSecrets.WithLabelValues(string(plan.Action), string(plan.Reason)).Inc()
+	}
+	switch plan.Action {
+	case secretActionNone:
+		countSecret()
+		log.Debugf("[%s] Secret [%s] is valid", namespace, secretName)
+	case secretActionCreate:
+		created, err := k8s.clientset.CoreV1().Secrets(namespace).Create(dockerconfigSecret(namespace, secretName, dockerConfigJSON))
+		if errors.IsAlreadyExists(err) {
+			// the cache has not seen the secret yet, its event reconciles it again
+			log.Debugf("[%s] Secret [%s] already exists", namespace, secretName)
+			return nil
+		}
 		if err != nil {
-			return fmt.Errorf("[%s] Failed to create secret: %v", namespace, err)
+			metricErrors.WithLabelValues(operationCreate).Inc()
+			return fmt.Errorf("[%s] Failed to create secret [%s]: %v", namespace, secretName, err)
 		}
-		log.Infof("[%s] Created secret", namespace)
-	} else if err != nil {
-		return fmt.Errorf("[%s] Failed to GET secret: %v", namespace, err)
-	} else {
-		if configManagedOnly && isManagedSecret(secret) {
-			return fmt.Errorf("[%s] Secret is present but unmanaged", namespace)
-		}
-		switch verifySecret(secret) {
-		case secretOk:
-			log.Debugf("[%s] Secret is valid", namespace)
-		case secretWrongType, secretNoKey, secretDataNotMatch:
-			if configForce {
-				log.Warnf("[%s] Secret is not valid, overwritting now", namespace)
-				err = k8s.clientset.CoreV1().Secrets(namespace).Delete(configSecretName, &metav1.DeleteOptions{})
-				if err != nil {
-					return fmt.Errorf("[%s] Failed to delete secret [%s]: %v", namespace, configSecretName, err)
-				}
-				log.Warnf("[%s] Deleted secret [%s]", namespace, configSecretName)
-				_, err = k8s.clientset.CoreV1().Secrets(namespace).Create(dockerconfigSecret(namespace))
-				if err != nil {
-					return fmt.Errorf("[%s] Failed to create secret: %v", namespace, err)
-				}
-				log.Infof("[%s] Created secret", namespace)
-			} else {
-				return fmt.Errorf("[%s] Secret is not valid, set --force to true to overwrite", namespace)
-			}
+		countSecret()
+		log.Infof("[%s] Created secret [%s]", namespace, secretName)
+		k8s.recordSecretEvent(ns, created, corev1.EventTypeNormal, eventReasonSecretCreated, "Created secret [%s]", secretName)
+	case secretActionUpdate:
+		log.Warnf("[%s] Secret [%s] is not valid (%s), overwritting now", namespace, secretName, plan.Reason)
+		if err := updateSecret(k8s, ns, secret, dockerConfigJSON, plan.Reason); err != nil {
+			return err
+		}
+		countSecret()
+	case secretActionReplace:
+		log.Warnf("[%s] Secret [%s] is not valid (%s), overwritting now", namespace, secretName, plan.Reason)
+		if err := recreateSecret(k8s, ns, secretName, dockerConfigJSON, plan.Reason); err != nil {
+			return err
 		}
+		countSecret()
+	case secretActionRefuseUnmanaged:
+		countSecret()
+		k8s.recordSecretEvent(ns, secret, corev1.EventTypeWarning, eventReasonSecretRefused, "Refused to overwrite secret [%s], it is present but unmanaged", secretName)
+		return fmt.Errorf("[%s] Secret [%s] is present but unmanaged", namespace, secretName)
+	case secretActionRefuseNoForce:
+		countSecret()
+		k8s.recordSecretEvent(ns, secret, corev1.EventTypeWarning, eventReasonSecretRefused, "Refused to overwrite secret [%s] (%s), force is disabled", secretName, plan.Reason)
+		return fmt.Errorf("[%s] Secret [%s] is not valid, set --force to true to overwrite", namespace, secretName)
 	}
 	return nil
 }
 
-func processServiceAccount(k8s *k8sClient, namespace string) error {
-	sas, err := k8s.clientset.CoreV1().ServiceAccounts(namespace).List(metav1.ListOptions{})
+// updateSecret overwrites the payload of a secret in place, keeping the labels
+// and annotations added by others. On conflict the secret is fetched again and
+// the update is retried.
+func updateSecret(k8s *k8sClient, ns *corev1.Namespace, secret *corev1.Secret, dockerConfigJSON string, reason verifySecretResult) error {
+	namespace, secretName := secret.Namespace, secret.Name
+	var updated *corev1.Secret
+	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		var err error
+		updated, err = k8s.clientset.CoreV1().Secrets(namespace).Update(updatedSecret(secret, dockerConfigJSON))
+		if !errors.IsConflict(err) {
+			return err
+		}
+		log.Debugf("[%s] Secret [%s] was modified, retrying the update", namespace, secretName)
+		latest, getErr := k8s.clientset.CoreV1().Secrets(namespace).Get(secretName, metav1.GetOptions{})
+		if getErr != nil {
+			return getErr
+		}
+		secret = latest
+		return err
+	})
 	if err != nil {
+		metricErrors.WithLabelValues(operationUpdate).Inc()
+		return fmt.Errorf("[%s] Failed to update secret [%s]: %v", namespace, secretName, err)
+	}
+	log.Infof("[%s] Updated secret [%s]", namespace, secretName)
+	k8s.recordSecretEvent(ns, updated, corev1.EventTypeNormal, eventReasonSecretUpdated, "Updated secret [%s] (%s)", secretName, reason)
+	return nil
+}
+
+// recreateSecret deletes a secret and creates it again with the expected type
+func recreateSecret(k8s *k8sClient, ns *corev1.Namespace, secretName, dockerConfigJSON string, reason verifySecretResult) error {
+	namespace := ns.Name
+	err := k8s.clientset.CoreV1().Secrets(namespace).Delete(secretName, &metav1.DeleteOptions{})
+	if err != nil && !errors.IsNotFound(err) {
+		metricErrors.WithLabelValues(operationDelete).Inc()
+		return fmt.Errorf("[%s] Failed to delete secret [%s]: %v", namespace, secretName, err)
+	}
+	log.Warnf("[%s] Deleted secret [%s]", namespace, secretName)
+	created, err := k8s.clientset.CoreV1().Secrets(namespace).Create(dockerconfigSecret(namespace, secretName, dockerConfigJSON))
+	if err != nil {
+		metricErrors.WithLabelValues(operationCreate).Inc()
+		return fmt.Errorf("[%s] Failed to create secret [%s]: %v", namespace, secretName, err)
+	}
+	log.Infof("[%s] Created secret [%s]", namespace, secretName)
+	k8s.recordSecretEvent(ns, created, corev1.EventTypeWarning, eventReasonSecretReplaced, "Replaced secret [%s] (%s)", secretName, reason)
+	return nil
+}
+
+// listManagedSecrets lists the secrets of a namespace annotated as managed by
+// this instance of the patcher, whatever their names
+func listManagedSecrets(k8s *k8sClient, namespace string) ([]*corev1.Secret, error) {
+	secrets, err := k8s.listSecrets(namespace, labels.Everything())
+	if err != nil {
+		metricErrors.WithLabelValues(operationList).Inc()
+		return nil, fmt.Errorf("[%s] Failed to list secrets: %v", namespace, err)
+	}
+	var managed []*corev1.Secret
+	for _, secret := range secrets {
+		if isManagedSecret(secret) && isInstanceSecret(secret) {
+			managed = append(managed, secret)
+		}
+	}
+	return managed, nil
+}
+
+// cleanupSecrets deletes the managed secrets of an excluded namespace, it is
+// used when `CONFIG_CLEANUP_EXCLUDED` is set
+func cleanupSecrets(k8s *k8sClient, ns *corev1.Namespace) error {
+	namespace := ns.Name
+	secrets, err := listManagedSecrets(k8s, namespace)
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, secret := range secrets {
+		// the precondition avoids deleting a secret which was replaced in between
+		err := k8s.clientset.CoreV1().Secrets(namespace).Delete(secret.Name, &metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &secret.UID},
+		})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			metricErrors.WithLabelValues(operationDelete).Inc()
+			errs = append(errs, fmt.Errorf("[%s] Failed to delete secret [%s]: %v", namespace, secret.Name, err))
+			continue
+		}
+		metricSecrets.WithLabelValues(string(secretActionDelete), "").Inc()
+		log.Infof("[%s] Deleted secret [%s] from excluded namespace", namespace, secret.Name)
+		k8s.recordSecretEvent(ns, secret, corev1.EventTypeNormal, eventReasonSecretDeleted, "Deleted secret [%s] from excluded namespace", secret.Name)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// listStaleSecrets lists the secrets of a namespace which were created by this
+// instance of the patcher under a name that is no longer configured, e.g. after
+// a change of `CONFIG_SECRETNAME`. The secrets of other instances are left to
+// them, as their names are not configured here either.
+func listStaleSecrets(k8s *k8sClient, namespace string) ([]*corev1.Secret, error) {
+	selector, err := labels.Parse(labelSecretName)
+	if err != nil {
+		return nil, err
+	}
+	secrets, err := k8s.listSecrets(namespace, selector)
+	if err != nil {
+		metricErrors.WithLabelValues(operationList).Inc()
+		return nil, fmt.Errorf("[%s] Failed to list secrets: %v", namespace, err)
+	}
+	var stale []*corev1.Secret
+	for _, secret := range secrets {
+		if isManagedSecret(secret) && secret.Labels[labelInstance] == configInstance && !isManagedSecretName(secret.Name) {
+			stale = append(stale, secret)
+		}
+	}
+	return stale, nil
+}
+
+// serviceAccountReferencesAny checks if a service account references or
+// tracks any of the given image pull secrets
+func serviceAccountReferencesAny(sa *corev1.ServiceAccount, secretNames []string) bool {
+	for _, name := range secretNames {
+		if includeImagePullSecret(sa, name) || !stringNotInSlice(name, trackedImagePullSecrets(sa)) {
+			return true
+		}
+	}
+	return false
+}
+
+// migrateSecrets removes the stale secrets of a namespace after the secret
+// name has changed. The references of service accounts are removed first, so
+// that no service account is left pointing to a deleted secret.
+func migrateSecrets(k8s *k8sClient, ns *corev1.Namespace) error {
+	namespace := ns.Name
+	stale, err := listStaleSecrets(k8s, namespace)
+	if err != nil || len(stale) == 0 {
+		return err
+	}
+	var staleNames []string
+	for _, secret := range stale {
+		staleNames = append(staleNames, secret.Name)
+	}
+
+	sas, err := k8s.listServiceAccounts(namespace)
+	if err != nil {
+		metricErrors.WithLabelValues(operationList).Inc()
+		return fmt.Errorf("[%s] Failed to list service accounts: %v", namespace, err)
+	}
+	for _, sa := range sas {
+		if !serviceAccountReferencesAny(sa, staleNames) {
+			continue
+		}
+		if err := removeImagePullSecrets(k8s, sa, staleNames); err != nil {
+			return err
+		}
+	}
+
+	var errs []error
+	for _, secret := range stale {
+		err := k8s.clientset.CoreV1().Secrets(namespace).Delete(secret.Name, &metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &secret.UID},
+		})
+		if errors.IsNotFound(err) {
+			continue
+		}
+		if err != nil {
+			metricErrors.WithLabelValues(operationDelete).Inc()
+			errs = append(errs, fmt.Errorf("[%s] Failed to delete secret [%s]: %v", namespace, secret.Name, err))
+			continue
+		}
+		metricSecrets.WithLabelValues(string(secretActionDelete), "").Inc()
+		log.Infof("[%s] Deleted secret [%s], it is no longer configured", namespace, secret.Name)
+		k8s.recordSecretEvent(ns, secret, corev1.EventTypeNormal, eventReasonSecretDeleted, "Deleted secret [%s], it is no longer configured", secret.Name)
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+func processServiceAccount(k8s *k8sClient, namespace string, secretNames []string) error {
+	sas, err := k8s.listServiceAccounts(namespace)
+	if err != nil {
+		metricErrors.WithLabelValues(operationList).Inc()
 		return fmt.Errorf("[%s] Failed to list service accounts: %v", namespace, err)
 	}
-	for _, sa := range sas.Items {
-		if !configAllServiceAccount && stringNotInList(sa.Name, configServiceAccounts) {
-			log.Debugf("[%s] Skip service account [%s]", namespace, sa.Name)
+	for _, sa := range sas {
+		if !serviceAccountIsTargeted(sa) {
+			if err := unpatchServiceAccount(k8s, sa); err != nil {
+				return err
+			}
 			continue
 		}
-		if includeImagePullSecret(&sa, configSecretName) {
+		if includeImagePullSecrets(sa, secretNames) {
 			log.Debugf("[%s] ImagePullSecrets found", namespace)
 			continue
 		}
-		patch, err := getPatchString(&sa, configSecretName)
+		patch, err := getPatchString(sa, secretNames)
 		if err != nil {
 			return fmt.Errorf("[%s] Failed to get patch string: %v", namespace, err)
 		}
-		_, err = k8s.clientset.CoreV1().ServiceAccounts(namespace).Patch(sa.Name, types.StrategicMergePatchType, patch)
+		patched, err := k8s.clientset.CoreV1().ServiceAccounts(namespace).Patch(sa.Name, types.StrategicMergePatchType, patch)
 		if err != nil {
+			metricErrors.WithLabelValues(operationPatch).Inc()
 			return fmt.Errorf("[%s] Failed to patch imagePullSecrets to service account [%s]: %v", namespace, sa.Name, err)
 		}
 		log.Infof("[%s] Patched imagePullSecrets to service account [%s]", namespace, sa.Name)
+		metricServiceAccountsPatched.Inc()
+		k8s.recordEvent(patched, corev1.EventTypeNormal, eventReasonServiceAccountPatched, "Patched imagePullSecrets [%s]", strings.Join(secretNames, ","))
+	}
+	return nil
+}
+
+// releaseNamespace undoes the changes made to a namespace which is no longer
+// processed: the image pull secrets added to its service accounts are removed,
+// and its managed secrets are deleted when `CONFIG_CLEANUP_EXCLUDED` is set
+func releaseNamespace(k8s *k8sClient, ns *corev1.Namespace) error {
+	if err := unpatchServiceAccounts(k8s, ns.Name); err != nil {
+		return err
+	}
+	if configCleanupExcluded {
+		return cleanupSecrets(k8s, ns)
+	}
+	return nil
+}
+
+// unpatchServiceAccounts removes the image pull secrets added by the patcher
+// from all service accounts of a namespace which is no longer processed
+func unpatchServiceAccounts(k8s *k8sClient, namespace string) error {
+	sas, err := k8s.listServiceAccounts(namespace)
+	if err != nil {
+		metricErrors.WithLabelValues(operationList).Inc()
+		return fmt.Errorf("[%s] Failed to list service accounts: %v", namespace, err)
+	}
+	var errs []error
+	for _, sa := range sas {
+		if err := unpatchServiceAccount(k8s, sa); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return utilerrors.NewAggregate(errs)
+}
+
+// unpatchServiceAccount removes the image pull secrets added by the patcher
+// from a service account which is no longer targeted. Only the secrets tracked
+// in its annotation are removed, as untracked references may have been added
+// by hand.
+func unpatchServiceAccount(k8s *k8sClient, sa *corev1.ServiceAccount) error {
+	if len(trackedImagePullSecrets(sa)) == 0 {
+		log.Debugf("[%s] Skip service account [%s]", sa.Namespace, sa.Name)
+		return nil
+	}
+	return removeImagePullSecrets(k8s, sa, trackedImagePullSecrets(sa))
+}
+
+// removeImagePullSecrets removes image pull secrets from a service account
+// with a json patch, together with their names in the tracking annotation
+func removeImagePullSecrets(k8s *k8sClient, sa *corev1.ServiceAccount, secretNames []string) error {
+	patch, removed, err := getUnpatchString(sa, secretNames)
+	if err != nil {
+		return fmt.Errorf("[%s] Failed to get patch string: %v", sa.Namespace, err)
 	}
+	patched, err := k8s.clientset.CoreV1().ServiceAccounts(sa.Namespace).Patch(sa.Name, types.JSONPatchType, patch)
+	if err != nil {
+		metricErrors.WithLabelValues(operationPatch).Inc()
+		return fmt.Errorf("[%s] Failed to remove imagePullSecrets from service account [%s]: %v", sa.Namespace, sa.Name, err)
+	}
+	log.Infof("[%s] Removed imagePullSecrets [%s] from service account [%s]", sa.Namespace, strings.Join(removed, ","), sa.Name)
+	metricServiceAccountsUnpatched.Inc()
+	k8s.recordEvent(patched, corev1.EventTypeNormal, eventReasonServiceAccountUnpatched, "Removed imagePullSecrets [%s]", strings.Join(removed, ","))
 	return nil
 }
 
-func stringNotInList(a string, list string) bool {
-	for _, b := range strings.Split(list, ",") {
-		if b == a {
-			return false
+// serviceAccountIsTargeted checks if a service account should be patched. The
+// exclude annotation opts it out even with `CONFIG_ALLSERVICEACCOUNT`, and the
+// include annotation opts it in when it is not in `CONFIG_SERVICEACCOUNTS`.
+func serviceAccountIsTargeted(sa *corev1.ServiceAccount) bool {
+	if sa.Annotations[annotationImagepullsecretPatcherExclude] == "true" {
+		return false
+	}
+	if sa.Annotations[annotationImagepullsecretPatcherInclude] == "true" {
+		return true
+	}
+	if configAllServiceAccount || stringMatchesGlobs(sa.Name, configServiceAccounts) {
+		return true
+	}
+	return serviceAccountSelector != nil && serviceAccountSelector.Matches(labels.Set(sa.Labels))
+}
+
+// stringMatchesGlobs checks if a string matches any glob of a comma-separated
+// list, a glob without wildcards matching only itself
+func stringMatchesGlobs(a string, list string) bool {
+	for _, glob := range strings.Split(list, ",") {
+		if matched, _ := path.Match(glob, a); matched {
+			return true
 		}
 	}
-	return true
+	return false
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"io/ioutil"
+	"strings"
 	"testing"
 
 	"github.com/sirupsen/logrus"
@@ -10,7 +11,10 @@ import (
 	v1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
 var testCasesProcessSecret = []testCase{
@@ -47,6 +51,34 @@ var testCasesProcessSecret = []testCase{
 			assertSecretIsValid,
 		},
 	},
+	{
+		name: "has outdated secret - update in place",
+		prepSteps: []step{
+			helperForceOn,
+			helperCreateOutdatedSecret,
+			assertSecretIsInvalid,
+		},
+		testSteps: []step{
+			processSecretDefault,
+			assertSecretIsValid,
+			assertSecretKeepsMetadata,
+			assertNoSecretDeleted,
+		},
+	},
+	{
+		name: "has outdated secret - retry update on conflict",
+		prepSteps: []step{
+			helperForceOn,
+			helperCreateOutdatedSecret,
+			helperConflictOnFirstSecretUpdate,
+		},
+		testSteps: []step{
+			processSecretDefault,
+			assertSecretIsValid,
+			assertSecretKeepsMetadata,
+			assertNoSecretDeleted,
+		},
+	},
 	{
 		name: "has invalid secret - force off",
 		prepSteps: []step{
@@ -61,6 +93,158 @@ var testCasesProcessSecret = []testCase{
 	},
 }
 
+// testCasesOwnership covers the decisions of processSecret on an existing
+// secret, by whether it is managed or marked for adoption
+var testCasesOwnership = []struct {
+	name        string
+	managedOnly bool
+	force       bool
+	annotations map[string]string
+	secretType  corev1.SecretType
+	data        string
+	expectError bool
+	// whether the secret carries the expected credential and is managed after processing
+	expectManaged bool
+}{
+	{
+		name:          "managed only - managed outdated secret is updated",
+		managedOnly:   true,
+		force:         true,
+		annotations:   map[string]string{annotationManagedBy: annotationAppName},
+		secretType:    corev1.SecretTypeDockerConfigJson,
+		data:          `{"auths":{}}`,
+		expectManaged: true,
+	},
+	{
+		name:          "managed only - managed valid secret is kept",
+		managedOnly:   true,
+		force:         false,
+		annotations:   map[string]string{annotationManagedBy: annotationAppName},
+		secretType:    corev1.SecretTypeDockerConfigJson,
+		data:          testDockerconfig,
+		expectManaged: true,
+	},
+	{
+		name:        "managed only - unmanaged outdated secret is refused",
+		managedOnly: true,
+		force:       true,
+		secretType:  corev1.SecretTypeDockerConfigJson,
+		data:        `{"auths":{}}`,
+		expectError: true,
+	},
+	{
+		name:        "managed only - unmanaged valid secret is refused",
+		managedOnly: true,
+		force:       true,
+		secretType:  corev1.SecretTypeDockerConfigJson,
+		data:        testDockerconfig,
+		expectError: true,
+	},
+	{
+		name:          "managed only - adopted outdated secret is taken over",
+		managedOnly:   true,
+		force:         false,
+		annotations:   map[string]string{annotationAdopt: "true"},
+		secretType:    corev1.SecretTypeDockerConfigJson,
+		data:          `{"auths":{}}`,
+		expectManaged: true,
+	},
+	{
+		name:          "managed only - adopted valid secret is taken over",
+		managedOnly:   true,
+		force:         false,
+		annotations:   map[string]string{annotationAdopt: "true"},
+		secretType:    corev1.SecretTypeDockerConfigJson,
+		data:          testDockerconfig,
+		expectManaged: true,
+	},
+	{
+		name:          "managed only - adopted secret of wrong type is replaced",
+		managedOnly:   true,
+		force:         false,
+		annotations:   map[string]string{annotationAdopt: "true"},
+		secretType:    corev1.SecretTypeOpaque,
+		expectManaged: true,
+	},
+	{
+		name:        "managed only - adoption must be true",
+		managedOnly: true,
+		force:       true,
+		annotations: map[string]string{annotationAdopt: "false"},
+		secretType:  corev1.SecretTypeDockerConfigJson,
+		data:        `{"auths":{}}`,
+		expectError: true,
+	},
+	{
+		name:          "unmanaged outdated secret is updated with force",
+		managedOnly:   false,
+		force:         true,
+		secretType:    corev1.SecretTypeDockerConfigJson,
+		data:          `{"auths":{}}`,
+		expectManaged: true,
+	},
+	{
+		name:        "unmanaged outdated secret is refused without force",
+		managedOnly: false,
+		force:       false,
+		secretType:  corev1.SecretTypeDockerConfigJson,
+		data:        `{"auths":{}}`,
+		expectError: true,
+	},
+	{
+		name:        "managed outdated secret is refused without force",
+		managedOnly: false,
+		force:       false,
+		annotations: map[string]string{annotationManagedBy: annotationAppName},
+		secretType:  corev1.SecretTypeDockerConfigJson,
+		data:        `{"auths":{}}`,
+		expectError: true,
+	},
+	{
+		name:          "adopted outdated secret is taken over without force",
+		managedOnly:   false,
+		force:         false,
+		annotations:   map[string]string{annotationAdopt: "true"},
+		secretType:    corev1.SecretTypeDockerConfigJson,
+		data:          `{"auths":{}}`,
+		expectManaged: true,
+	},
+}
+
+func TestProcessSecretOwnership(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	defer func() {
+		configManagedOnly = false
+		configForce = true
+	}()
+	for _, tc := range testCasesOwnership {
+		configManagedOnly = tc.managedOnly
+		configForce = tc.force
+		k8s := &k8sClient{clientset: fake.NewSimpleClientset(&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        configSecretName,
+				Namespace:   v1.NamespaceDefault,
+				Annotations: tc.annotations,
+			},
+			Type: tc.secretType,
+			Data: map[string][]byte{corev1.DockerConfigJsonKey: []byte(tc.data)},
+		})}
+
+		err := processSecretDefault(k8s)
+		if hasError := err != nil; hasError != tc.expectError {
+			t.Errorf("TestProcessSecretOwnership(%s) has error %v, expects error %v", tc.name, err, tc.expectError)
+		}
+		secret, err := k8s.clientset.CoreV1().Secrets(v1.NamespaceDefault).Get(configSecretName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatalf("TestProcessSecretOwnership(%s) lost the secret: %v", tc.name, err)
+		}
+		managed := isManagedSecret(secret) && verifySecret(secret, testDockerconfig) == secretOk
+		if managed != tc.expectManaged {
+			t.Errorf("TestProcessSecretOwnership(%s) gives a valid managed secret %v, expects %v", tc.name, managed, tc.expectManaged)
+		}
+	}
+}
+
 var testCasesProcessServiceAccount = []testCase{
 	{
 		name: "no image pull secret",
@@ -121,6 +305,230 @@ var testCasesProcessServiceAccount = []testCase{
 			assertHasImagePullSecret(configSecretName, "other-service-account"),
 		},
 	},
+	{
+		name: "non-default service account - remove added secret when allServiceAccount off",
+		prepSteps: []step{
+			helperAllServiceAccountOn,
+			helperCreateServiceAccountWithImagePullSecret("other-secret", "other-service-account"),
+			processServiceAccountDefault,
+			assertHasImagePullSecret(configSecretName, "other-service-account"),
+		},
+		testSteps: []step{
+			helperAllServiceAccountOff,
+			processServiceAccountDefault,
+			assertHasError(assertHasImagePullSecret(configSecretName, "other-service-account")),
+			assertHasImagePullSecret("other-secret", "other-service-account"),
+		},
+	},
+	{
+		name: "service account opted out - skip when allServiceAccount on",
+		prepSteps: []step{
+			helperAllServiceAccountOn,
+			helperCreateAnnotatedServiceAccount("workload-identity", annotationImagepullsecretPatcherExclude),
+		},
+		testSteps: []step{
+			processServiceAccountDefault,
+			assertHasError(assertHasImagePullSecret(configSecretName, "workload-identity")),
+		},
+	},
+	{
+		name: "service account opted in - patch when allServiceAccount off",
+		prepSteps: []step{
+			helperAllServiceAccountOff,
+			helperCreateAnnotatedServiceAccount("builder", annotationImagepullsecretPatcherInclude),
+		},
+		testSteps: []step{
+			processServiceAccountDefault,
+			assertHasImagePullSecret(configSecretName, "builder"),
+		},
+	},
+	{
+		name: "default service account opted out",
+		prepSteps: []step{
+			helperAllServiceAccountOff,
+			helperCreateAnnotatedServiceAccount(defaultServiceAccountName, annotationImagepullsecretPatcherExclude),
+		},
+		testSteps: []step{
+			processServiceAccountDefault,
+			assertHasError(assertHasImagePullSecret(configSecretName, defaultServiceAccountName)),
+		},
+	},
+}
+
+var testCasesProcessNamespace = []testCase{
+	{
+		name: "multiple secrets",
+		prepSteps: []step{
+			helperMultipleSecrets("registry-a", "registry-b"),
+			helperCreateServiceAccountWithImagePullSecret("other-secret", defaultServiceAccountName),
+		},
+		testSteps: []step{
+			processNamespaceDefault,
+			assertNamedSecretIsValid("registry-a"),
+			assertNamedSecretIsValid("registry-b"),
+			assertHasImagePullSecret("other-secret", defaultServiceAccountName),
+			assertHasImagePullSecret("registry-a", defaultServiceAccountName),
+			assertHasImagePullSecret("registry-b", defaultServiceAccountName),
+		},
+	},
+	{
+		name: "multiple secrets - skip patching invalid secret",
+		prepSteps: []step{
+			helperForceOff,
+			helperMultipleSecrets(configSecretName, "registry-b"),
+			helperCreateOpaqueSecret,
+			helperCreateServiceAccountWithoutImagePullSecret(defaultServiceAccountName),
+		},
+		testSteps: []step{
+			assertHasError(processNamespaceDefault),
+			assertSecretIsInvalid,
+			assertNamedSecretIsValid("registry-b"),
+			assertHasError(assertHasImagePullSecret(configSecretName, defaultServiceAccountName)),
+			assertHasImagePullSecret("registry-b", defaultServiceAccountName),
+		},
+	},
+	{
+		name: "renamed secret - migrate service accounts and delete old secret",
+		prepSteps: []step{
+			helperMultipleSecrets("old-secret"),
+			helperCreateServiceAccountWithImagePullSecret("other-secret", defaultServiceAccountName),
+			processNamespaceDefault,
+			assertHasImagePullSecret("old-secret", defaultServiceAccountName),
+		},
+		testSteps: []step{
+			helperMultipleSecrets("new-secret"),
+			processNamespaceDefault,
+			assertNamedSecretIsValid("new-secret"),
+			assertHasImagePullSecret("new-secret", defaultServiceAccountName),
+			assertHasImagePullSecret("other-secret", defaultServiceAccountName),
+			assertHasError(assertHasImagePullSecret("old-secret", defaultServiceAccountName)),
+			assertHasError(assertSecretExists("old-secret")),
+		},
+	},
+	{
+		name: "renamed secret - keep old secret while new one is refused",
+		prepSteps: []step{
+			helperForceOff,
+			helperMultipleSecrets("old-secret"),
+			processNamespaceDefault,
+			helperCreateOpaqueSecret,
+		},
+		testSteps: []step{
+			helperMultipleSecrets(configSecretName),
+			assertHasError(processNamespaceDefault),
+			assertSecretExists("old-secret"),
+		},
+	},
+	{
+		name: "renamed secret - keep secrets of another instance",
+		prepSteps: []step{
+			helperInstance("other"),
+			helperMultipleSecrets("other-secret"),
+			processNamespaceDefault,
+			helperInstance("default"),
+		},
+		testSteps: []step{
+			helperMultipleSecrets(configSecretName),
+			processNamespaceDefault,
+			assertSecretIsValid,
+			assertSecretExists("other-secret"),
+		},
+	},
+	{
+		name: "excluded namespace - remove added secrets",
+		prepSteps: []step{
+			helperMultipleSecrets(configSecretName),
+			helperCreateServiceAccountWithImagePullSecret("other-secret", defaultServiceAccountName),
+			processNamespaceDefault,
+			assertHasImagePullSecret(configSecretName, defaultServiceAccountName),
+		},
+		testSteps: []step{
+			helperExcludeNamespace(v1.NamespaceDefault),
+			processNamespaceDefault,
+			helperExcludeNamespace(""),
+			assertHasError(assertHasImagePullSecret(configSecretName, defaultServiceAccountName)),
+			assertHasImagePullSecret("other-secret", defaultServiceAccountName),
+		},
+	},
+	{
+		name: "untargeted service account - keep managed secret added by hand",
+		prepSteps: []step{
+			helperMultipleSecrets(configSecretName),
+			helperCreateServiceAccountWithImagePullSecret(configSecretName, "builder"),
+		},
+		testSteps: []step{
+			processNamespaceDefault,
+			assertHasImagePullSecret(configSecretName, "builder"),
+		},
+	},
+	{
+		name: "excluded namespace - keep managed secret added by hand",
+		prepSteps: []step{
+			helperMultipleSecrets(configSecretName),
+			helperCreateServiceAccountWithImagePullSecret(configSecretName, defaultServiceAccountName),
+			processNamespaceDefault,
+		},
+		testSteps: []step{
+			helperExcludeNamespace(v1.NamespaceDefault),
+			processNamespaceDefault,
+			helperExcludeNamespace(""),
+			assertHasImagePullSecret(configSecretName, defaultServiceAccountName),
+		},
+	},
+	{
+		name: "excluded namespace - delete managed secrets when cleanup on",
+		prepSteps: []step{
+			helperMultipleSecrets(configSecretName),
+			helperCreateUnmanagedSecret("other-secret"),
+			processNamespaceDefault,
+			assertSecretIsValid,
+		},
+		testSteps: []step{
+			helperExcludeNamespace(v1.NamespaceDefault),
+			helperCleanupExcluded(true),
+			processNamespaceDefault,
+			helperCleanupExcluded(false),
+			helperExcludeNamespace(""),
+			assertNoSecret,
+			assertSecretExists("other-secret"),
+		},
+	},
+	{
+		name: "excluded namespace - keep secrets of another instance",
+		prepSteps: []step{
+			helperCreateServiceAccountWithoutImagePullSecret(defaultServiceAccountName),
+			helperInstance("other"),
+			helperMultipleSecrets("other-secret"),
+			processNamespaceDefault,
+			helperInstance("default"),
+			helperMultipleSecrets(configSecretName),
+			processNamespaceDefault,
+		},
+		testSteps: []step{
+			helperExcludeNamespace(v1.NamespaceDefault),
+			helperCleanupExcluded(true),
+			processNamespaceDefault,
+			helperCleanupExcluded(false),
+			helperExcludeNamespace(""),
+			assertNoSecret,
+			assertHasError(assertHasImagePullSecret(configSecretName, defaultServiceAccountName)),
+			assertSecretExists("other-secret"),
+			assertHasImagePullSecret("other-secret", defaultServiceAccountName),
+		},
+	},
+	{
+		name: "excluded namespace - keep managed secrets when cleanup off",
+		prepSteps: []step{
+			helperMultipleSecrets(configSecretName),
+			processNamespaceDefault,
+		},
+		testSteps: []step{
+			helperExcludeNamespace(v1.NamespaceDefault),
+			processNamespaceDefault,
+			helperExcludeNamespace(""),
+			assertSecretIsValid,
+		},
+	},
 }
 
 func TestProcessSecret(t *testing.T) {
@@ -135,6 +543,12 @@ func TestProcessServiceAccount(t *testing.T) {
 	}
 }
 
+func TestProcessNamespace(t *testing.T) {
+	for _, tc := range testCasesProcessNamespace {
+		runTestCase(t, "ProcessNamespace", tc)
+	}
+}
+
 type step func(*k8sClient) error
 
 type testCase struct {
@@ -170,17 +584,149 @@ func runTestCase(t *testing.T, testName string, tc testCase) {
 }
 
 func processSecretDefault(k8s *k8sClient) error {
-	return processSecret(k8s, v1.NamespaceDefault)
+	return processSecret(k8s, &v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: v1.NamespaceDefault,
+		},
+	}, configSecretName, testDockerconfig)
 }
 
 func processServiceAccountDefault(k8s *k8sClient) error {
-	return processServiceAccount(k8s, v1.NamespaceDefault)
+	return processServiceAccount(k8s, v1.NamespaceDefault, []string{configSecretName})
+}
+
+func processNamespaceDefault(k8s *k8sClient) error {
+	return processNamespace(k8s, v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: v1.NamespaceDefault,
+		},
+	})
+}
+
+func TestLoopRetriesTransientErrors(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	transientErrorBackoff = testBackoff
+	configForce = true
+	configAllServiceAccount = false
+	excludedNamespaces = nil
+
+	clientset := fake.NewSimpleClientset(&v1.Namespace{
+		ObjectMeta: metav1.ObjectMeta{Name: v1.NamespaceDefault},
+	})
+	failures := 0
+	clientset.PrependReactor("list", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if failures < 2 {
+			failures++
+			return true, nil, fmt.Errorf("connection refused")
+		}
+		return false, nil, nil
+	})
+	managedSecrets = []*managedSecret{
+		{name: configSecretName, source: staticCredentialSource(testDockerconfig)},
+		{name: "not-loaded", source: fileCredentialSource("/not/exist")},
+	}
+
+	k8s := &k8sClient{clientset: clientset}
+	if err := loop(k8s); err == nil {
+		t.Errorf("loop should fail when credentials cannot be loaded")
+	}
+	// listing namespaces is retried, and the loaded secrets are processed
+	if err := assertSecretIsValid(k8s); err != nil {
+		t.Error(err)
+	}
+	if _, err := clientset.CoreV1().Secrets(v1.NamespaceDefault).Get("not-loaded", metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("loop should skip secrets whose credentials are not loaded")
+	}
+
+	clientset.PrependReactor("list", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("connection refused")
+	})
+	if err := loop(k8s); err == nil {
+		t.Errorf("loop should fail when listing namespaces keeps failing")
+	}
+}
+
+func TestLoopFailedNamespaces(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	configForce = true
+	excludedNamespaces = nil
+	clientset := fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a"}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-b"}},
+	)
+	clientset.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() == "team-b" {
+			return true, nil, fmt.Errorf("forbidden")
+		}
+		return false, nil, nil
+	})
+	managedSecrets = []*managedSecret{
+		{name: configSecretName, source: staticCredentialSource(testDockerconfig)},
+	}
+
+	k8s := &k8sClient{clientset: clientset}
+	err := loop(k8s)
+	if err == nil || !strings.Contains(err.Error(), "Failed to process 1 of 2 namespaces") {
+		t.Errorf("loop should fail when a namespace fails, got %v", err)
+	}
+	if _, err := clientset.CoreV1().Secrets("team-a").Get(configSecretName, metav1.GetOptions{}); err != nil {
+		t.Errorf("loop should process the other namespaces, got %v", err)
+	}
+}
+
+func TestLoopNamespaceSelector(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	configForce = true
+	excludedNamespaces = nil
+	selector, err := labels.Parse("team in (a,b),!sandbox")
+	if err != nil {
+		t.Fatal(err)
+	}
+	namespaceSelector = selector
+	defer func() {
+		namespaceSelector = labels.Everything()
+	}()
+
+	clientset := fake.NewSimpleClientset(
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a", Labels: map[string]string{"team": "a"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-a-sandbox", Labels: map[string]string{"team": "a", "sandbox": "true"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "team-c", Labels: map[string]string{"team": "c"}}},
+		&v1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "unlabeled"}},
+	)
+	var listSelector string
+	clientset.PrependReactor("list", "namespaces", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		listSelector = action.(k8stesting.ListAction).GetListRestrictions().Labels.String()
+		return false, nil, nil
+	})
+	managedSecrets = []*managedSecret{
+		{name: configSecretName, source: staticCredentialSource(testDockerconfig), loaded: true, dockerConfigJSON: testDockerconfig},
+	}
+
+	k8s := &k8sClient{clientset: clientset}
+	if err := loop(k8s); err != nil {
+		t.Fatalf("loop has error %v", err)
+	}
+	if listSelector != selector.String() {
+		t.Errorf("loop lists namespaces with selector [%s], expects [%s]", listSelector, selector.String())
+	}
+	for namespace, expected := range map[string]bool{
+		"team-a":         true,
+		"team-a-sandbox": false,
+		"team-c":         false,
+		"unlabeled":      false,
+	} {
+		_, err := clientset.CoreV1().Secrets(namespace).Get(configSecretName, metav1.GetOptions{})
+		if created := err == nil; created != expected {
+			t.Errorf("loop creates secret in namespace [%s]: %v, expects %v", namespace, created, expected)
+		}
+	}
 }
 
 func TestNamespaceIsExcluded(t *testing.T) {
 	for _, tc := range []struct {
 		name      string
 		config    string
+		include   string
 		namespace corev1.Namespace
 		expected  bool
 	}{
@@ -214,6 +760,77 @@ func TestNamespaceIsExcluded(t *testing.T) {
 			},
 			expected: false,
 		},
+		{
+			name:   "glob in config",
+			config: "default,kube-*",
+			namespace: corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "kube-system",
+				},
+			},
+			expected: true,
+		},
+		{
+			name:   "glob not matching",
+			config: "*-system",
+			namespace: corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "system-a",
+				},
+			},
+			expected: false,
+		},
+		{
+			name:   "regexp in config",
+			config: "re:^pr-[0-9]+$",
+			namespace: corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "pr-1234",
+				},
+			},
+			expected: true,
+		},
+		{
+			name:   "regexp not matching",
+			config: "re:^pr-[0-9]+$",
+			namespace: corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "pr-1234-app",
+				},
+			},
+			expected: false,
+		},
+		{
+			name:    "in include list",
+			include: "team-*,re:^ci-[0-9]+$",
+			namespace: corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "ci-42",
+				},
+			},
+			expected: false,
+		},
+		{
+			name:    "not in include list",
+			include: "team-*,re:^ci-[0-9]+$",
+			namespace: corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "default",
+				},
+			},
+			expected: true,
+		},
+		{
+			name:    "in include list but excluded",
+			config:  "team-sandbox",
+			include: "team-*",
+			namespace: corev1.Namespace{
+				ObjectMeta: metav1.ObjectMeta{
+					Name: "team-sandbox",
+				},
+			},
+			expected: true,
+		},
 		{
 			name:   "namespace has annotation true",
 			config: "",
@@ -228,16 +845,24 @@ func TestNamespaceIsExcluded(t *testing.T) {
 			expected: true,
 		},
 	} {
-		configExcludedNamespaces = tc.config
+		var err error
+		if excludedNamespaces, err = parseNamespacePatterns(tc.config); err != nil {
+			t.Fatalf("TestNamespaceIsExcluded(%s) has error %v", tc.name, err)
+		}
+		if includedNamespaces, err = parseNamespacePatterns(tc.include); err != nil {
+			t.Fatalf("TestNamespaceIsExcluded(%s) has error %v", tc.name, err)
+		}
 		if actual := namespaceIsExcluded(tc.namespace); actual != tc.expected {
 			t.Errorf("TestNamespaceIsExcluded(%s) failed: expected %v, got %v", tc.name, tc.expected, actual)
 		}
 	}
+	excludedNamespaces = nil
+	includedNamespaces = nil
 }
 
 // a set of helper functions
 func helperCreateValidSecret(k8s *k8sClient) error {
-	_, err := k8s.clientset.CoreV1().Secrets(v1.NamespaceDefault).Create(dockerconfigSecret(v1.NamespaceDefault))
+	_, err := k8s.clientset.CoreV1().Secrets(v1.NamespaceDefault).Create(dockerconfigSecret(v1.NamespaceDefault, configSecretName, testDockerconfig))
 	return err
 }
 
@@ -252,6 +877,36 @@ func helperCreateOpaqueSecret(k8s *k8sClient) error {
 	return err
 }
 
+func helperCreateOutdatedSecret(k8s *k8sClient) error {
+	_, err := k8s.clientset.CoreV1().Secrets(v1.NamespaceDefault).Create(&v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        configSecretName,
+			Namespace:   v1.NamespaceDefault,
+			Labels:      map[string]string{"team": "a"},
+			Annotations: map[string]string{"owner": "team-a"},
+		},
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{}}`),
+		},
+		Type: corev1.SecretTypeDockerConfigJson,
+	})
+	return err
+}
+
+// helperConflictOnFirstSecretUpdate makes the first secret update fail with
+// a conflict, as if the secret was modified concurrently
+func helperConflictOnFirstSecretUpdate(k8s *k8sClient) error {
+	conflicted := false
+	k8s.clientset.(*fake.Clientset).PrependReactor("update", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if conflicted {
+			return false, nil, nil
+		}
+		conflicted = true
+		return true, nil, errors.NewConflict(v1.Resource("secrets"), configSecretName, fmt.Errorf("the object has been modified"))
+	})
+	return nil
+}
+
 func helperCreateServiceAccountWithoutImagePullSecret(serviceAccountName string) step {
 	return func(k8s *k8sClient) error {
 		_, err := k8s.clientset.CoreV1().ServiceAccounts(v1.NamespaceDefault).Create(&v1.ServiceAccount{
@@ -264,6 +919,19 @@ func helperCreateServiceAccountWithoutImagePullSecret(serviceAccountName string)
 	}
 }
 
+func helperCreateAnnotatedServiceAccount(serviceAccountName, annotation string) step {
+	return func(k8s *k8sClient) error {
+		_, err := k8s.clientset.CoreV1().ServiceAccounts(v1.NamespaceDefault).Create(&v1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        serviceAccountName,
+				Namespace:   v1.NamespaceDefault,
+				Annotations: map[string]string{annotation: "true"},
+			},
+		})
+		return err
+	}
+}
+
 func helperCreateServiceAccountWithImagePullSecret(secretName, serviceAccountName string) step {
 	return func(k8s *k8sClient) error {
 		_, err := k8s.clientset.CoreV1().ServiceAccounts(v1.NamespaceDefault).Create(&v1.ServiceAccount{
@@ -281,6 +949,55 @@ func helperCreateServiceAccountWithImagePullSecret(secretName, serviceAccountNam
 	}
 }
 
+func helperMultipleSecrets(secretNames ...string) step {
+	return func(_ *k8sClient) error {
+		managedSecrets = nil
+		for _, secretName := range secretNames {
+			managedSecrets = append(managedSecrets, &managedSecret{
+				name:             secretName,
+				loaded:           true,
+				dockerConfigJSON: testDockerconfig,
+			})
+		}
+		return nil
+	}
+}
+
+func helperExcludeNamespace(patterns string) step {
+	return func(_ *k8sClient) error {
+		var err error
+		excludedNamespaces, err = parseNamespacePatterns(patterns)
+		return err
+	}
+}
+
+func helperInstance(instance string) step {
+	return func(_ *k8sClient) error {
+		configInstance = instance
+		return nil
+	}
+}
+
+func helperCleanupExcluded(cleanup bool) step {
+	return func(_ *k8sClient) error {
+		configCleanupExcluded = cleanup
+		return nil
+	}
+}
+
+func helperCreateUnmanagedSecret(secretName string) step {
+	return func(k8s *k8sClient) error {
+		_, err := k8s.clientset.CoreV1().Secrets(v1.NamespaceDefault).Create(&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      secretName,
+				Namespace: v1.NamespaceDefault,
+			},
+			Type: corev1.SecretTypeOpaque,
+		})
+		return err
+	}
+}
+
 func helperForceOn(_ *k8sClient) error {
 	configForce = true
 	return nil
@@ -302,6 +1019,13 @@ func helperAllServiceAccountOff(_ *k8sClient) error {
 }
 
 // a set of assertion functions
+func assertSecretExists(secretName string) step {
+	return func(k8s *k8sClient) error {
+		_, err := k8s.clientset.CoreV1().Secrets(v1.NamespaceDefault).Get(secretName, metav1.GetOptions{})
+		return err
+	}
+}
+
 func assertNoSecret(k8s *k8sClient) error {
 	_, err := k8s.clientset.CoreV1().Secrets(v1.NamespaceDefault).Get(configSecretName, metav1.GetOptions{})
 	if errors.IsNotFound(err) {
@@ -318,7 +1042,7 @@ func assertSecretIsValid(k8s *k8sClient) error {
 	if err != nil {
 		return fmt.Errorf("assert secret valid but no found")
 	}
-	if result := verifySecret(secret); result != secretOk {
+	if result := verifySecret(secret, testDockerconfig); result != secretOk {
 		return fmt.Errorf("assert secret valid but invalid: %v", result)
 	}
 	return nil
@@ -329,12 +1053,45 @@ func assertSecretIsInvalid(k8s *k8sClient) error {
 	if err != nil {
 		return fmt.Errorf("assert secret invalid but no found")
 	}
-	if result := verifySecret(secret); result == secretOk {
+	if result := verifySecret(secret, testDockerconfig); result == secretOk {
 		return fmt.Errorf("assert secret invalid but valid")
 	}
 	return nil
 }
 
+func assertSecretKeepsMetadata(k8s *k8sClient) error {
+	secret, err := k8s.clientset.CoreV1().Secrets(v1.NamespaceDefault).Get(configSecretName, metav1.GetOptions{})
+	if err != nil {
+		return err
+	}
+	if secret.Labels["team"] != "a" || secret.Annotations["owner"] != "team-a" {
+		return fmt.Errorf("assert secret keeps labels and annotations but got %v %v", secret.Labels, secret.Annotations)
+	}
+	return nil
+}
+
+func assertNoSecretDeleted(k8s *k8sClient) error {
+	for _, action := range k8s.clientset.(*fake.Clientset).Actions() {
+		if action.Matches("delete", "secrets") {
+			return fmt.Errorf("assert no secret deleted but deleted")
+		}
+	}
+	return nil
+}
+
+func assertNamedSecretIsValid(secretName string) step {
+	return func(k8s *k8sClient) error {
+		secret, err := k8s.clientset.CoreV1().Secrets(v1.NamespaceDefault).Get(secretName, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("assert secret [%s] valid but no found", secretName)
+		}
+		if result := verifySecret(secret, testDockerconfig); result != secretOk {
+			return fmt.Errorf("assert secret [%s] valid but invalid: %v", secretName, result)
+		}
+		return nil
+	}
+}
+
 func assertHasError(fn step) step {
 	return func(k8s *k8sClient) error {
 		if err := fn(k8s); err == nil {
@@ -356,3 +1113,79 @@ func assertHasImagePullSecret(secretName, serviceAccountName string) step {
 		return fmt.Errorf("assert has image pull secret [%s] but not found", secretName)
 	}
 }
+
+func TestServiceAccountIsTargeted(t *testing.T) {
+	defer func() {
+		configServiceAccounts = defaultServiceAccountName
+		serviceAccountSelector = nil
+	}()
+	configAllServiceAccount = false
+
+	for _, tc := range []struct {
+		name            string
+		serviceAccounts string
+		selector        string
+		sa              v1.ServiceAccount
+		expected        bool
+	}{
+		{
+			name:            "name in list",
+			serviceAccounts: "default,deployer",
+			sa:              v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "deployer"}},
+			expected:        true,
+		},
+		{
+			name:            "name not in list",
+			serviceAccounts: "default",
+			sa:              v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "deployer"}},
+			expected:        false,
+		},
+		{
+			name:            "glob in list",
+			serviceAccounts: "default,builder-*",
+			sa:              v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "builder-team-a"}},
+			expected:        true,
+		},
+		{
+			name:            "label matching selector",
+			serviceAccounts: "default",
+			selector:        "ci.example.com/runner=true",
+			sa: v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+				Name:   "runner",
+				Labels: map[string]string{"ci.example.com/runner": "true"},
+			}},
+			expected: true,
+		},
+		{
+			name:            "label not matching selector",
+			serviceAccounts: "default",
+			selector:        "ci.example.com/runner=true",
+			sa:              v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "runner"}},
+			expected:        false,
+		},
+		{
+			name:            "selector with opt-out annotation",
+			serviceAccounts: "default",
+			selector:        "ci.example.com/runner=true",
+			sa: v1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+				Name:        "runner",
+				Labels:      map[string]string{"ci.example.com/runner": "true"},
+				Annotations: map[string]string{annotationImagepullsecretPatcherExclude: "true"},
+			}},
+			expected: false,
+		},
+	} {
+		configServiceAccounts = tc.serviceAccounts
+		serviceAccountSelector = nil
+		if tc.selector != "" {
+			selector, err := labels.Parse(tc.selector)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serviceAccountSelector = selector
+		}
+		if actual := serviceAccountIsTargeted(&tc.sa); actual != tc.expected {
+			t.Errorf("TestServiceAccountIsTargeted(%s) failed: expected %v, got %v", tc.name, tc.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	metricsNamespace = "imagepullsecret_patcher"
+
+	// operation label values of metricErrors
+	operationGet    = "get"
+	operationList   = "list"
+	operationCreate = "create"
+	operationUpdate = "update"
+	operationDelete = "delete"
+	operationPatch  = "patch"
+	operationLoad   = "load"
+)
+
+var (
+	metricSecrets = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "secrets_total",
+		Help:      "Number of secrets processed, by the action taken and the result of verifying the existing secret. Failed writes are only counted in errors_total.",
+	}, []string{"action", "reason"})
+	metricServiceAccountsPatched = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "service_accounts_patched_total",
+		Help:      "Number of service accounts patched with image pull secrets.",
+	})
+	metricServiceAccountsUnpatched = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "service_accounts_unpatched_total",
+		Help:      "Number of service accounts whose image pull secrets were removed because they are no longer targeted.",
+	})
+	metricErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "errors_total",
+		Help:      "Number of failed operations, by operation.",
+	}, []string{"operation"})
+	metricNamespacesSkipped = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "namespaces_skipped_total",
+		Help:      "Number of times a namespace was skipped because it is excluded.",
+	})
+	metricSyncDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "sync_duration_seconds",
+		Help:      "Duration of processing all namespaces once.",
+		Buckets:   prometheus.ExponentialBuckets(0.1, 2, 12),
+	})
+	metricLastSuccessfulSync = prometheus.NewGauge(prometheus.GaugeOpts{
+		Namespace: metricsNamespace,
+		Name:      "last_successful_sync_timestamp_seconds",
+		Help:      "Unix time of the last sync in which all namespaces were processed without error.",
+	})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricSecrets,
+		metricServiceAccountsPatched,
+		metricServiceAccountsUnpatched,
+		metricErrors,
+		metricNamespacesSkipped,
+		metricSyncDuration,
+		metricLastSuccessfulSync,
+	)
+}
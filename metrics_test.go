@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func TestMetricsEndpoint(t *testing.T) {
+	metricServiceAccountsPatched.Inc()
+	metricErrors.WithLabelValues(operationPatch).Inc()
+
+	server := httptest.NewServer(newHTTPHandler())
+	defer server.Close()
+	resp, err := server.Client().Get(server.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{
+		"imagepullsecret_patcher_service_accounts_patched_total",
+		`imagepullsecret_patcher_errors_total{operation="patch"}`,
+		"imagepullsecret_patcher_sync_duration_seconds_bucket",
+		"imagepullsecret_patcher_last_successful_sync_timestamp_seconds",
+	} {
+		if !strings.Contains(string(body), name) {
+			t.Errorf("/metrics should expose %s", name)
+		}
+	}
+}
+
+func TestMetricSecretsCountsSucceededWrites(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	clientset := fake.NewSimpleClientset()
+	k8s := &k8sClient{clientset: clientset}
+	ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "default"}}
+	created := metricSecrets.WithLabelValues(string(secretActionCreate), "")
+	createErrors := metricErrors.WithLabelValues(operationCreate)
+
+	clientset.PrependReactor("create", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, fmt.Errorf("test error")
+	})
+	before, beforeErrors := testutil.ToFloat64(created), testutil.ToFloat64(createErrors)
+	if err := processSecret(k8s, ns, configSecretName, testDockerconfig); err == nil {
+		t.Fatal("processSecret should fail when the secret cannot be created")
+	}
+	if testutil.ToFloat64(created) != before {
+		t.Errorf("secrets_total should not count a failed create")
+	}
+	if testutil.ToFloat64(createErrors) != beforeErrors+1 {
+		t.Errorf("errors_total should count a failed create")
+	}
+
+	clientset.ReactionChain = clientset.ReactionChain[1:]
+	if err := processSecret(k8s, ns, configSecretName, testDockerconfig); err != nil {
+		t.Fatal(err)
+	}
+	if testutil.ToFloat64(created) != before+1 {
+		t.Errorf("secrets_total should count a created secret")
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// prefix of the patterns written as regular expressions, other patterns are
+// globs, e.g. `kube-*`
+const namespacePatternRegexp = "re:"
+
+// namespacePattern matches namespace names, either with a glob or a regexp
+type namespacePattern struct {
+	glob   string
+	regexp *regexp.Regexp
+}
+
+func (p namespacePattern) matches(name string) bool {
+	if p.regexp != nil {
+		return p.regexp.MatchString(name)
+	}
+	matched, _ := path.Match(p.glob, name)
+	return matched
+}
+
+// namespacePatterns matches a namespace name when any of its patterns does
+type namespacePatterns []namespacePattern
+
+func (ps namespacePatterns) matches(name string) bool {
+	for _, p := range ps {
+		if p.matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// parseNamespacePatterns parses a comma-separated list of patterns, where a
+// pattern is a glob like `*-system` or a regexp like `re:^ci-[0-9]+$`.
+// Regexps are not anchored unless written so.
+func parseNamespacePatterns(list string) (namespacePatterns, error) {
+	patterns := namespacePatterns{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		if strings.HasPrefix(entry, namespacePatternRegexp) {
+			re, err := regexp.Compile(strings.TrimPrefix(entry, namespacePatternRegexp))
+			if err != nil {
+				return nil, fmt.Errorf("Invalid namespace pattern [%s]: %v", entry, err)
+			}
+			patterns = append(patterns, namespacePattern{regexp: re})
+			continue
+		}
+		if _, err := path.Match(entry, ""); err != nil {
+			return nil, fmt.Errorf("Invalid namespace pattern [%s]: %v", entry, err)
+		}
+		patterns = append(patterns, namespacePattern{glob: entry})
+	}
+	return patterns, nil
+}
@@ -0,0 +1,33 @@
+package main
+
+import "testing"
+
+func TestParseNamespacePatterns(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		input    string
+		expected int
+		hasError bool
+	}{
+		{name: "empty", input: "", expected: 0},
+		{name: "names and globs", input: "default, kube-*,*-system", expected: 3},
+		{name: "regexp", input: "re:^ci-[0-9]+$", expected: 1},
+		{name: "invalid glob", input: "kube-[", hasError: true},
+		{name: "invalid regexp", input: "re:ci-(", hasError: true},
+	} {
+		patterns, err := parseNamespacePatterns(tc.input)
+		if tc.hasError {
+			if err == nil {
+				t.Errorf("parseNamespacePatterns(%s) expects error but not", tc.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseNamespacePatterns(%s) has error %v", tc.name, err)
+			continue
+		}
+		if len(patterns) != tc.expected {
+			t.Errorf("parseNamespacePatterns(%s) gives %d patterns, expects %d", tc.name, len(patterns), tc.expected)
+		}
+	}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// transientErrorBackoff retries an operation 6 times, waiting 1s, 2s, 4s, 8s
+// and 16s in between, so that a blip of the API server or a mounted file being
+// swapped does not fail a whole sync
+var transientErrorBackoff = wait.Backoff{
+	Duration: time.Second,
+	Factor:   2,
+	Jitter:   0.1,
+	Steps:    6,
+}
+
+// retryTransient calls fn until it succeeds or backoff is exhausted, and
+// returns the last error
+func retryTransient(backoff wait.Backoff, description string, fn func() error) error {
+	var lastErr error
+	err := wait.ExponentialBackoff(backoff, func() (bool, error) {
+		if lastErr = fn(); lastErr != nil {
+			log.Warnf("%s failed, retrying: %v", description, lastErr)
+			return false, nil
+		}
+		return true, nil
+	})
+	if err == wait.ErrWaitTimeout {
+		return lastErr
+	}
+	return err
+}
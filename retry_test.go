@@ -0,0 +1,49 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var testBackoff = wait.Backoff{
+	Duration: time.Millisecond,
+	Factor:   2,
+	Steps:    3,
+}
+
+func TestRetryTransient(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	for _, testCase := range []struct {
+		name          string
+		failures      int
+		expectedCalls int
+		hasError      bool
+	}{
+		{name: "success", failures: 0, expectedCalls: 1},
+		{name: "transient", failures: 2, expectedCalls: 3},
+		{name: "persistent", failures: 5, expectedCalls: 3, hasError: true},
+	} {
+		calls := 0
+		err := retryTransient(testBackoff, testCase.name, func() error {
+			calls++
+			if calls <= testCase.failures {
+				return fmt.Errorf("failure %d", calls)
+			}
+			return nil
+		})
+		if calls != testCase.expectedCalls {
+			t.Errorf("retryTransient(%s) calls %d times, expects %d", testCase.name, calls, testCase.expectedCalls)
+		}
+		if (err != nil) != testCase.hasError {
+			t.Errorf("retryTransient(%s) gives error %v, expects error %v", testCase.name, err, testCase.hasError)
+		}
+		if testCase.hasError && err.Error() != "failure 3" {
+			t.Errorf("retryTransient(%s) should return the last error, got %v", testCase.name, err)
+		}
+	}
+}
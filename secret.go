@@ -1,42 +1,70 @@
 package main
 
 import (
-	"io/ioutil"
-
 	corev1 "k8s.io/api/core/v1"
 	v1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 type verifySecretResult string
 
+// secretAction is what processSecret does to a secret in a namespace
+type secretAction string
+
 const (
 	// annotation constants
 	annotationManagedBy = "app.kubernetes.io/managed-by"
 	annotationAppName   = "imagepullsecret-patcher"
+	// label recording the name a managed secret was created with, so that
+	// secrets left behind by a rename of the configured secret can be found
+	labelSecretName = "k8s.titansoft.com/imagepullsecret-patcher-secret"
+	// label recording the `CONFIG_INSTANCE` which manages a secret, so that a
+	// rename only removes the secrets of the instance it happened to
+	labelInstance = "k8s.titansoft.com/imagepullsecret-patcher-instance"
+	// instance owning the managed secrets and tracked image pull secrets which
+	// were created before instances existed
+	defaultInstance = "default"
+	// annotation a namespace owner sets to "true" to let the patcher take over
+	// an existing secret it did not create
+	annotationAdopt = "k8s.titansoft.com/imagepullsecret-patcher-adopt"
 
 	// result code for verifySecret
 	secretOk           verifySecretResult = "SecretOk"
 	secretWrongType    verifySecretResult = "SecretWrongType"
 	secretNoKey        verifySecretResult = "SecretNoKey"
 	secretDataNotMatch verifySecretResult = "SecretDataNotMatch"
+	// a valid managed secret created before it was labeled, or labeled by
+	// another instance
+	secretNoLabel verifySecretResult = "SecretNoLabel"
+	// a valid secret marked for adoption, which is not managed yet
+	secretAdopted verifySecretResult = "SecretAdopted"
+
+	// actions decided by planSecret
+	secretActionNone            secretAction = "None"
+	secretActionCreate          secretAction = "Create"
+	secretActionUpdate          secretAction = "Update"
+	secretActionReplace         secretAction = "Replace"
+	secretActionRefuseUnmanaged secretAction = "RefuseUnmanaged"
+	secretActionRefuseNoForce   secretAction = "RefuseNoForce"
+	// a managed secret is deleted from an excluded namespace
+	secretActionDelete secretAction = "Delete"
 )
 
-// getDockerConfigJSON is a dynamic getter for our secret value. It lets us
-// dynamically fetch the value from file or return the hard coded value,
-// providing a consistent interface for access
-func getDockerConfigJSON() (string, error) {
-	if configDockerConfigJSONPath != "" {
-		b, ok := ioutil.ReadFile(configDockerConfigJSONPath)
-		return string(b), ok
-	}
-	return configDockerconfigjson, nil
+// secretPlan is the action to take on a secret, and the reason of overwriting it
+type secretPlan struct {
+	Name   string             `json:"name"`
+	Action secretAction       `json:"action"`
+	Reason verifySecretResult `json:"reason,omitempty"`
 }
 
-func dockerconfigSecret(namespace string) *corev1.Secret {
+func dockerconfigSecret(namespace, secretName, dockerConfigJSON string) *corev1.Secret {
 	return &corev1.Secret{
 		ObjectMeta: v1.ObjectMeta{
-			Name:      configSecretName,
+			Name:      secretName,
 			Namespace: namespace,
+			Labels: map[string]string{
+				labelSecretName: secretName,
+				labelInstance:   configInstance,
+			},
 			Annotations: map[string]string{
 				annotationManagedBy: annotationAppName,
 			},
@@ -48,7 +76,72 @@ func dockerconfigSecret(namespace string) *corev1.Secret {
 	}
 }
 
-func verifySecret(secret *corev1.Secret) verifySecretResult {
+// updatedSecret returns a copy of a secret carrying the given payload, keeping
+// its other data, labels and annotations
+func updatedSecret(secret *corev1.Secret, dockerConfigJSON string) *corev1.Secret {
+	updated := secret.DeepCopy()
+	if updated.Annotations == nil {
+		updated.Annotations = map[string]string{}
+	}
+	updated.Annotations[annotationManagedBy] = annotationAppName
+	if updated.Labels == nil {
+		updated.Labels = map[string]string{}
+	}
+	updated.Labels[labelSecretName] = updated.Name
+	updated.Labels[labelInstance] = configInstance
+	if updated.Data == nil {
+		updated.Data = map[string][]byte{}
+	}
+	updated.Data[corev1.DockerConfigJsonKey] = []byte(dockerConfigJSON)
+	return updated
+}
+
+// planSecret decides the action to take on an existing secret, or on a
+// missing one when secret is nil
+func planSecret(secretName string, secret *corev1.Secret, dockerConfigJSON string) secretPlan {
+	plan := secretPlan{Name: secretName}
+	if secret == nil {
+		plan.Action = secretActionCreate
+		return plan
+	}
+	managed := isManagedSecret(secret)
+	adopted := !managed && isAdoptedSecret(secret)
+	if configManagedOnly && !managed && !adopted {
+		plan.Action = secretActionRefuseUnmanaged
+		return plan
+	}
+	plan.Reason = verifySecret(secret, dockerConfigJSON)
+	switch {
+	case plan.Reason == secretOk && adopted:
+		// only the annotation and label change, to mark the secret as managed
+		plan.Action = secretActionUpdate
+		plan.Reason = secretAdopted
+	case plan.Reason == secretOk && managed && (secret.Labels[labelSecretName] != secretName || secret.Labels[labelInstance] != configInstance):
+		// only the labels change, so it does not need `CONFIG_FORCE`
+		plan.Action = secretActionUpdate
+		plan.Reason = secretNoLabel
+	case plan.Reason == secretOk:
+		plan.Action = secretActionNone
+		plan.Reason = ""
+	case !configForce && !adopted:
+		// the adoption annotation is the consent of the namespace owner to
+		// overwrite the secret
+		plan.Action = secretActionRefuseNoForce
+	case plan.Reason == secretWrongType:
+		// the type of a secret is immutable, so it has to be recreated
+		plan.Action = secretActionReplace
+	default:
+		plan.Action = secretActionUpdate
+	}
+	return plan
+}
+
+// isRefused checks if a plan leaves an invalid secret untouched
+func (p secretPlan) isRefused() bool {
+	return p.Action == secretActionRefuseUnmanaged || p.Action == secretActionRefuseNoForce
+}
+
+func verifySecret(secret *corev1.Secret, dockerConfigJSON string) verifySecretResult {
 	if secret.Type != corev1.SecretTypeDockerConfigJson {
 		return secretWrongType
 	}
@@ -62,6 +155,21 @@ func verifySecret(secret *corev1.Secret) verifySecretResult {
 	return secretOk
 }
 
+// isAdoptedSecret checks if a secret is marked to be taken over by the patcher
+func isAdoptedSecret(secret *corev1.Secret) bool {
+	return secret.Annotations[annotationAdopt] == "true"
+}
+
+// isInstanceSecret checks if a secret belongs to this instance of the patcher,
+// a secret without the instance label belonging to the default instance
+func isInstanceSecret(secret *corev1.Secret) bool {
+	instance, ok := secret.Labels[labelInstance]
+	if !ok {
+		instance = defaultInstance
+	}
+	return instance == configInstance
+}
+
 func isManagedSecret(secret *corev1.Secret) bool {
 	if k, ok := secret.ObjectMeta.Annotations[annotationManagedBy]; ok {
 		if k == annotationAppName {
@@ -59,9 +59,8 @@ var testCasesVerifySecret = []struct {
 }
 
 func TestVerifySecret(t *testing.T) {
-	dockerConfigJSON = testDockerconfig
 	for _, testCase := range testCasesVerifySecret {
-		actual := verifySecret(testCase.input)
+		actual := verifySecret(testCase.input, testDockerconfig)
 		if actual != testCase.expected {
 			t.Errorf("verifySecret(%s) gives %s, expects %s", testCase.name, actual, testCase.expected)
 		}
@@ -69,7 +68,7 @@ func TestVerifySecret(t *testing.T) {
 }
 
 func TestDockerconfigSecretIsValid(t *testing.T) {
-	result := verifySecret(dockerconfigSecret("default"))
+	result := verifySecret(dockerconfigSecret("default", configSecretName, testDockerconfig), testDockerconfig)
 	if result != secretOk {
 		t.Errorf("dockerconfigSecret generates invalid secret: %s", result)
 	}
@@ -120,3 +119,123 @@ func TestIsManagedSecret(t *testing.T) {
 		}
 	}
 }
+
+func TestUpdatedSecret(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Labels:      map[string]string{"team": "a"},
+			Annotations: map[string]string{"owner": "team-a"},
+		},
+		Type: corev1.SecretTypeDockerConfigJson,
+		Data: map[string][]byte{
+			corev1.DockerConfigJsonKey: []byte(`{"auths":{}}`),
+		},
+	}
+	updated := updatedSecret(secret, testDockerconfig)
+	if result := verifySecret(updated, testDockerconfig); result != secretOk {
+		t.Errorf("updatedSecret generates invalid secret: %s", result)
+	}
+	if !isManagedSecret(updated) {
+		t.Errorf("updatedSecret should annotate the secret as managed")
+	}
+	if updated.Labels["team"] != "a" || updated.Annotations["owner"] != "team-a" {
+		t.Errorf("updatedSecret should keep labels and annotations, got %v %v", updated.Labels, updated.Annotations)
+	}
+	if string(secret.Data[corev1.DockerConfigJsonKey]) != `{"auths":{}}` {
+		t.Errorf("updatedSecret should not modify the original secret")
+	}
+}
+
+var testCasesPlanSecret = []struct {
+	name     string
+	force    bool
+	input    *corev1.Secret
+	expected secretPlan
+}{
+	{
+		name:     "missing",
+		force:    true,
+		input:    nil,
+		expected: secretPlan{Name: "secret-a", Action: secretActionCreate},
+	},
+	{
+		name:     "valid",
+		force:    true,
+		input:    testCasesVerifySecret[0].input,
+		expected: secretPlan{Name: "secret-a", Action: secretActionNone},
+	},
+	{
+		name:     "wrong type",
+		force:    true,
+		input:    testCasesVerifySecret[1].input,
+		expected: secretPlan{Name: "secret-a", Action: secretActionReplace, Reason: secretWrongType},
+	},
+	{
+		name:     "no key",
+		force:    true,
+		input:    testCasesVerifySecret[2].input,
+		expected: secretPlan{Name: "secret-a", Action: secretActionUpdate, Reason: secretNoKey},
+	},
+	{
+		name:     "data not match",
+		force:    true,
+		input:    testCasesVerifySecret[3].input,
+		expected: secretPlan{Name: "secret-a", Action: secretActionUpdate, Reason: secretDataNotMatch},
+	},
+	{
+		name:  "valid managed secret without label",
+		force: false,
+		input: &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "secret-a",
+				Annotations: map[string]string{annotationManagedBy: annotationAppName},
+			},
+			Type: corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(testDockerconfig),
+			},
+		},
+		expected: secretPlan{Name: "secret-a", Action: secretActionUpdate, Reason: secretNoLabel},
+	},
+	{
+		name:  "valid managed secret without instance label",
+		force: false,
+		input: &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "secret-a",
+				Labels:      map[string]string{labelSecretName: "secret-a"},
+				Annotations: map[string]string{annotationManagedBy: annotationAppName},
+			},
+			Type: corev1.SecretTypeDockerConfigJson,
+			Data: map[string][]byte{
+				corev1.DockerConfigJsonKey: []byte(testDockerconfig),
+			},
+		},
+		expected: secretPlan{Name: "secret-a", Action: secretActionUpdate, Reason: secretNoLabel},
+	},
+	{
+		name:     "valid managed secret with label",
+		force:    true,
+		input:    dockerconfigSecret("default", "secret-a", testDockerconfig),
+		expected: secretPlan{Name: "secret-a", Action: secretActionNone},
+	},
+	{
+		name:     "data not match - force off",
+		force:    false,
+		input:    testCasesVerifySecret[3].input,
+		expected: secretPlan{Name: "secret-a", Action: secretActionRefuseNoForce, Reason: secretDataNotMatch},
+	},
+}
+
+func TestPlanSecret(t *testing.T) {
+	defer func() {
+		configForce = true
+	}()
+	for _, testCase := range testCasesPlanSecret {
+		configForce = testCase.force
+		actual := planSecret("secret-a", testCase.input, testDockerconfig)
+		if actual != testCase.expected {
+			t.Errorf("planSecret(%s) gives %+v, expects %+v", testCase.name, actual, testCase.expected)
+		}
+	}
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	log "github.com/sirupsen/logrus"
+)
+
+// newHTTPHandler returns the handler of the HTTP server, serving `/metrics`
+// and the `/healthz` and `/readyz` probes
+func newHTTPHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.Handle("/healthz", healthHandler(func() error {
+		return controllerHealth.alive(time.Now(), livenessTimeout())
+	}))
+	mux.Handle("/readyz", healthHandler(func() error {
+		return controllerHealth.ready()
+	}))
+	return mux
+}
+
+// serveHTTP starts the HTTP server in background, unless addr is empty
+func serveHTTP(addr string) {
+	if addr == "" {
+		return
+	}
+	go func() {
+		log.Infof("Serving HTTP on [%s]", addr)
+		if err := http.ListenAndServe(addr, newHTTPHandler()); err != nil {
+			log.Panic(err)
+		}
+	}()
+}
@@ -2,6 +2,8 @@ package main
 
 import (
 	"encoding/json"
+	"fmt"
+	"strings"
 
 	corev1 "k8s.io/api/core/v1"
 )
@@ -21,15 +23,156 @@ func includeImagePullSecret(sa *corev1.ServiceAccount, secretName string) bool {
 
 type patch struct {
 	ImagePullSecrets []corev1.LocalObjectReference `json:"imagePullSecrets,omitempty"`
+	Metadata         *patchMetadata                `json:"metadata,omitempty"`
 }
 
-func getPatchString(sa *corev1.ServiceAccount, secretName string) ([]byte, error) {
+type patchMetadata struct {
+	Annotations map[string]string `json:"annotations"`
+}
+
+// getPatchString returns a strategic merge patch adding the missing image pull
+// secrets to a service account, and recording them in the tracking annotation
+// so that they can be removed later
+func getPatchString(sa *corev1.ServiceAccount, secretNames []string) ([]byte, error) {
 	saPatch := patch{
 		// copy the slice
 		ImagePullSecrets: append([]corev1.LocalObjectReference(nil), sa.ImagePullSecrets...),
 	}
-	if !includeImagePullSecret(sa, secretName) {
-		saPatch.ImagePullSecrets = append(saPatch.ImagePullSecrets, corev1.LocalObjectReference{Name: secretName})
+	tracked := parseTrackedSecrets(sa)
+	added := false
+	for _, secretName := range secretNames {
+		if !includeImagePullSecret(sa, secretName) {
+			saPatch.ImagePullSecrets = append(saPatch.ImagePullSecrets, corev1.LocalObjectReference{Name: secretName})
+			tracked = append(tracked, trackedSecret{instance: configInstance, name: secretName})
+			added = true
+		}
+	}
+	if added {
+		saPatch.Metadata = &patchMetadata{Annotations: map[string]string{
+			annotationImagepullsecretPatcherSecrets: formatTrackedSecrets(tracked),
+		}}
 	}
 	return json.Marshal(saPatch)
 }
+
+// trackedSecret is an image pull secret recorded in the tracking annotation,
+// together with the instance of the patcher which added it
+type trackedSecret struct {
+	instance string
+	name     string
+}
+
+// parseTrackedSecrets returns the image pull secrets recorded in the tracking
+// annotation of a service account by all instances. The secrets of the default
+// instance are recorded by name, as they were before instances existed, and the
+// others as `<instance>/<name>`.
+func parseTrackedSecrets(sa *corev1.ServiceAccount) []trackedSecret {
+	var tracked []trackedSecret
+	for _, entry := range strings.Split(sa.Annotations[annotationImagepullsecretPatcherSecrets], ",") {
+		if entry == "" {
+			continue
+		}
+		secret := trackedSecret{instance: defaultInstance, name: entry}
+		if i := strings.Index(entry, "/"); i >= 0 {
+			secret = trackedSecret{instance: entry[:i], name: entry[i+1:]}
+		}
+		tracked = append(tracked, secret)
+	}
+	return tracked
+}
+
+// formatTrackedSecrets returns the value of the tracking annotation recording
+// the given image pull secrets
+func formatTrackedSecrets(tracked []trackedSecret) string {
+	var entries []string
+	for _, secret := range tracked {
+		if secret.instance == defaultInstance {
+			entries = append(entries, secret.name)
+		} else {
+			entries = append(entries, secret.instance+"/"+secret.name)
+		}
+	}
+	return strings.Join(entries, ",")
+}
+
+// trackedImagePullSecrets returns the image pull secrets added by this instance
+// of the patcher, as recorded in the tracking annotation of a service account
+func trackedImagePullSecrets(sa *corev1.ServiceAccount) []string {
+	var names []string
+	for _, secret := range parseTrackedSecrets(sa) {
+		if secret.instance == configInstance {
+			names = append(names, secret.name)
+		}
+	}
+	return names
+}
+
+type jsonPatchOperation struct {
+	Op    string `json:"op"`
+	Path  string `json:"path"`
+	Value string `json:"value,omitempty"`
+}
+
+// getUnpatchString returns a json patch removing the given image pull secrets
+// from a service account and from the entries of this instance in its tracking
+// annotation, and the names of the secrets actually removed. A secret still
+// tracked by another instance is kept. Every removal is preceded by a test of
+// the secret name, so that the patch fails rather than removing another secret
+// when the list has changed in between.
+func getUnpatchString(sa *corev1.ServiceAccount, secretNames []string) ([]byte, []string, error) {
+	var remaining []trackedSecret
+	var kept []string
+	for _, secret := range parseTrackedSecrets(sa) {
+		if secret.instance == configInstance && !stringNotInSlice(secret.name, secretNames) {
+			continue
+		}
+		remaining = append(remaining, secret)
+		if secret.instance != configInstance {
+			kept = append(kept, secret.name)
+		}
+	}
+
+	var ops []jsonPatchOperation
+	var removed []string
+	// remove from the end, so that the indexes of the remaining secrets do not shift
+	for i := len(sa.ImagePullSecrets) - 1; i >= 0; i-- {
+		name := sa.ImagePullSecrets[i].Name
+		if stringNotInSlice(name, secretNames) || !stringNotInSlice(name, kept) {
+			continue
+		}
+		ops = append(ops,
+			jsonPatchOperation{Op: "test", Path: fmt.Sprintf("/imagePullSecrets/%d/name", i), Value: name},
+			jsonPatchOperation{Op: "remove", Path: fmt.Sprintf("/imagePullSecrets/%d", i)},
+		)
+		removed = append([]string{name}, removed...)
+	}
+	if _, ok := sa.Annotations[annotationImagepullsecretPatcherSecrets]; ok {
+		annotationPath := "/metadata/annotations/" + strings.Replace(annotationImagepullsecretPatcherSecrets, "/", "~1", -1)
+		if len(remaining) == 0 {
+			ops = append(ops, jsonPatchOperation{Op: "remove", Path: annotationPath})
+		} else {
+			ops = append(ops, jsonPatchOperation{Op: "replace", Path: annotationPath, Value: formatTrackedSecrets(remaining)})
+		}
+	}
+	patch, err := json.Marshal(ops)
+	return patch, removed, err
+}
+
+func stringNotInSlice(a string, list []string) bool {
+	for _, b := range list {
+		if b == a {
+			return false
+		}
+	}
+	return true
+}
+
+// includeImagePullSecrets checks if a service account has all given image pull secrets
+func includeImagePullSecrets(sa *corev1.ServiceAccount, secretNames []string) bool {
+	for _, secretName := range secretNames {
+		if !includeImagePullSecret(sa, secretName) {
+			return false
+		}
+	}
+	return true
+}
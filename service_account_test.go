@@ -1,9 +1,11 @@
 package main
 
 import (
+	"reflect"
 	"testing"
 
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var testCasesIncludeImagePullSecret = []struct {
@@ -56,39 +58,71 @@ func TestIncludeImagePullSecret(t *testing.T) {
 }
 
 var testCasesGetPatchString = []struct {
-	name       string
-	sa         *corev1.ServiceAccount
-	secretName string
-	expected   []byte
+	name        string
+	instance    string
+	sa          *corev1.ServiceAccount
+	secretNames []string
+	expected    []byte
 }{
 	{
 		name: "empty",
 		sa: &corev1.ServiceAccount{
 			ImagePullSecrets: []corev1.LocalObjectReference{}},
-		secretName: "secret-a",
-		expected:   []byte(`{"imagePullSecrets":[{"name":"secret-a"}]}`),
+		secretNames: []string{"secret-a"},
+		expected:    []byte(`{"imagePullSecrets":[{"name":"secret-a"}],"metadata":{"annotations":{"k8s.titansoft.com/imagepullsecret-patcher-secrets":"secret-a"}}}`),
 	},
 	{
 		name: "same",
 		sa: &corev1.ServiceAccount{
 			ImagePullSecrets: []corev1.LocalObjectReference{
 				{Name: "secret-a"}}},
-		secretName: "secret-a",
-		expected:   []byte(`{"imagePullSecrets":[{"name":"secret-a"}]}`),
+		secretNames: []string{"secret-a"},
+		expected:    []byte(`{"imagePullSecrets":[{"name":"secret-a"}]}`),
 	},
 	{
 		name: "different",
 		sa: &corev1.ServiceAccount{
 			ImagePullSecrets: []corev1.LocalObjectReference{
 				{Name: "secret-b"}}},
-		secretName: "secret-a",
-		expected:   []byte(`{"imagePullSecrets":[{"name":"secret-b"},{"name":"secret-a"}]}`),
+		secretNames: []string{"secret-a"},
+		expected:    []byte(`{"imagePullSecrets":[{"name":"secret-b"},{"name":"secret-a"}],"metadata":{"annotations":{"k8s.titansoft.com/imagepullsecret-patcher-secrets":"secret-a"}}}`),
+	},
+	{
+		name: "multiple",
+		sa: &corev1.ServiceAccount{
+			ImagePullSecrets: []corev1.LocalObjectReference{
+				{Name: "secret-b"}}},
+		secretNames: []string{"secret-a", "secret-b", "secret-c"},
+		expected:    []byte(`{"imagePullSecrets":[{"name":"secret-b"},{"name":"secret-a"},{"name":"secret-c"}],"metadata":{"annotations":{"k8s.titansoft.com/imagepullsecret-patcher-secrets":"secret-a,secret-c"}}}`),
+	},
+	{
+		name: "already tracked",
+		sa: &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{annotationImagepullsecretPatcherSecrets: "secret-a"}},
+			ImagePullSecrets: []corev1.LocalObjectReference{
+				{Name: "secret-a"}}},
+		secretNames: []string{"secret-a", "secret-b"},
+		expected:    []byte(`{"imagePullSecrets":[{"name":"secret-a"},{"name":"secret-b"}],"metadata":{"annotations":{"k8s.titansoft.com/imagepullsecret-patcher-secrets":"secret-a,secret-b"}}}`),
+	},
+	{
+		name:     "tracked by another instance",
+		instance: "team",
+		sa: &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{annotationImagepullsecretPatcherSecrets: "secret-a"}},
+			ImagePullSecrets: []corev1.LocalObjectReference{
+				{Name: "secret-a"}}},
+		secretNames: []string{"secret-b"},
+		expected:    []byte(`{"imagePullSecrets":[{"name":"secret-a"},{"name":"secret-b"}],"metadata":{"annotations":{"k8s.titansoft.com/imagepullsecret-patcher-secrets":"secret-a,team/secret-b"}}}`),
 	},
 }
 
 func TestGetPatchString(t *testing.T) {
+	defer helperRestoreInstance()()
 	for _, testCase := range testCasesGetPatchString {
-		actual, err := getPatchString(testCase.sa, testCase.secretName)
+		configInstance = helperTestInstance(testCase.instance)
+		actual, err := getPatchString(testCase.sa, testCase.secretNames)
 		if err != nil {
 			t.Errorf("getPatchString(%s) has error %v", testCase.name, err)
 		}
@@ -97,3 +131,135 @@ func TestGetPatchString(t *testing.T) {
 		}
 	}
 }
+
+var testCasesGetUnpatchString = []struct {
+	name            string
+	instance        string
+	sa              *corev1.ServiceAccount
+	secretNames     []string
+	expected        []byte
+	expectedRemoved []string
+}{
+	{
+		name: "tracked secrets among others",
+		sa: &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{annotationImagepullsecretPatcherSecrets: "secret-a,secret-c"}},
+			ImagePullSecrets: []corev1.LocalObjectReference{
+				{Name: "secret-a"}, {Name: "secret-b"}, {Name: "secret-c"}}},
+		secretNames: []string{"secret-a", "secret-c"},
+		expected: []byte(`[{"op":"test","path":"/imagePullSecrets/2/name","value":"secret-c"},{"op":"remove","path":"/imagePullSecrets/2"},` +
+			`{"op":"test","path":"/imagePullSecrets/0/name","value":"secret-a"},{"op":"remove","path":"/imagePullSecrets/0"},` +
+			`{"op":"remove","path":"/metadata/annotations/k8s.titansoft.com~1imagepullsecret-patcher-secrets"}]`),
+		expectedRemoved: []string{"secret-a", "secret-c"},
+	},
+	{
+		name: "tracked secret removed by hand",
+		sa: &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{annotationImagepullsecretPatcherSecrets: "secret-a"}},
+			ImagePullSecrets: []corev1.LocalObjectReference{
+				{Name: "secret-b"}}},
+		secretNames: []string{"secret-a"},
+		expected:    []byte(`[{"op":"remove","path":"/metadata/annotations/k8s.titansoft.com~1imagepullsecret-patcher-secrets"}]`),
+	},
+	{
+		name: "renamed secret among tracked ones",
+		sa: &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{annotationImagepullsecretPatcherSecrets: "secret-a,secret-b"}},
+			ImagePullSecrets: []corev1.LocalObjectReference{
+				{Name: "secret-a"}, {Name: "secret-b"}}},
+		secretNames: []string{"secret-a"},
+		expected: []byte(`[{"op":"test","path":"/imagePullSecrets/0/name","value":"secret-a"},{"op":"remove","path":"/imagePullSecrets/0"},` +
+			`{"op":"replace","path":"/metadata/annotations/k8s.titansoft.com~1imagepullsecret-patcher-secrets","value":"secret-b"}]`),
+		expectedRemoved: []string{"secret-a"},
+	},
+	{
+		name: "untracked secret",
+		sa: &corev1.ServiceAccount{
+			ImagePullSecrets: []corev1.LocalObjectReference{
+				{Name: "secret-a"}}},
+		secretNames:     []string{"secret-a"},
+		expected:        []byte(`[{"op":"test","path":"/imagePullSecrets/0/name","value":"secret-a"},{"op":"remove","path":"/imagePullSecrets/0"}]`),
+		expectedRemoved: []string{"secret-a"},
+	},
+	{
+		name:     "secrets tracked by several instances",
+		instance: "team",
+		sa: &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{annotationImagepullsecretPatcherSecrets: "secret-a,team/secret-b"}},
+			ImagePullSecrets: []corev1.LocalObjectReference{
+				{Name: "secret-a"}, {Name: "secret-b"}}},
+		secretNames: []string{"secret-a", "secret-b"},
+		expected: []byte(`[{"op":"test","path":"/imagePullSecrets/1/name","value":"secret-b"},{"op":"remove","path":"/imagePullSecrets/1"},` +
+			`{"op":"replace","path":"/metadata/annotations/k8s.titansoft.com~1imagepullsecret-patcher-secrets","value":"secret-a"}]`),
+		expectedRemoved: []string{"secret-b"},
+	},
+	{
+		name: "secret also tracked by another instance",
+		sa: &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Annotations: map[string]string{annotationImagepullsecretPatcherSecrets: "secret-a,team/secret-a"}},
+			ImagePullSecrets: []corev1.LocalObjectReference{
+				{Name: "secret-a"}}},
+		secretNames: []string{"secret-a"},
+		expected:    []byte(`[{"op":"replace","path":"/metadata/annotations/k8s.titansoft.com~1imagepullsecret-patcher-secrets","value":"team/secret-a"}]`),
+	},
+}
+
+func TestGetUnpatchString(t *testing.T) {
+	defer helperRestoreInstance()()
+	for _, testCase := range testCasesGetUnpatchString {
+		configInstance = helperTestInstance(testCase.instance)
+		actual, removed, err := getUnpatchString(testCase.sa, testCase.secretNames)
+		if err != nil {
+			t.Errorf("getUnpatchString(%s) has error %v", testCase.name, err)
+		}
+		if string(actual) != string(testCase.expected) {
+			t.Errorf("getUnpatchString(%s) gives %s, expects %s", testCase.name, actual, testCase.expected)
+		}
+		if !reflect.DeepEqual(removed, testCase.expectedRemoved) {
+			t.Errorf("getUnpatchString(%s) removes %v, expects %v", testCase.name, removed, testCase.expectedRemoved)
+		}
+	}
+}
+
+func TestTrackedImagePullSecrets(t *testing.T) {
+	defer helperRestoreInstance()()
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Annotations: map[string]string{annotationImagepullsecretPatcherSecrets: "secret-a,team/secret-b,,team/secret-c"}},
+	}
+	for _, testCase := range []struct {
+		instance string
+		expected []string
+	}{
+		{instance: defaultInstance, expected: []string{"secret-a"}},
+		{instance: "team", expected: []string{"secret-b", "secret-c"}},
+		{instance: "other", expected: nil},
+	} {
+		configInstance = testCase.instance
+		if actual := trackedImagePullSecrets(sa); !reflect.DeepEqual(actual, testCase.expected) {
+			t.Errorf("trackedImagePullSecrets(%s) gives %v, expects %v", testCase.instance, actual, testCase.expected)
+		}
+	}
+}
+
+// helperRestoreInstance returns a function restoring `configInstance`
+func helperRestoreInstance() func() {
+	instance := configInstance
+	return func() {
+		configInstance = instance
+	}
+}
+
+// helperTestInstance returns the instance of a test case, the default one
+// when it is not set
+func helperTestInstance(instance string) string {
+	if instance == "" {
+		return defaultInstance
+	}
+	return instance
+}
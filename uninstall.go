@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"io"
+
+	log "github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// name of the subcommand removing everything the patcher has created
+const commandUninstall = "uninstall"
+
+// uninstallSummary counts what uninstall has removed, or would remove
+type uninstallSummary struct {
+	namespaces      int
+	secrets         int
+	serviceAccounts int
+	failures        int
+}
+
+// uninstall removes the image pull secrets this instance of the patcher added
+// to service accounts and deletes its managed secrets in all namespaces,
+// regardless of exclusions and selectors. With dryRun, it only writes what it
+// would remove. It returns an error when anything could not be removed.
+func uninstall(k8s *k8sClient, out io.Writer, dryRun bool) error {
+	namespaces, err := k8s.clientset.CoreV1().Namespaces().List(metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("Failed to list namespaces: %v", err)
+	}
+	log.Debugf("Got %d namespaces", len(namespaces.Items))
+
+	verb := "Removed"
+	if dryRun {
+		verb = "Would remove"
+	}
+	summary := uninstallSummary{}
+	for i := range namespaces.Items {
+		if uninstallNamespace(k8s, out, &namespaces.Items[i], dryRun, &summary) {
+			summary.namespaces++
+		}
+	}
+	fmt.Fprintf(out, "%s %d secrets and the image pull secrets of %d service accounts in %d namespaces\n",
+		verb, summary.secrets, summary.serviceAccounts, summary.namespaces)
+	if summary.failures > 0 {
+		return fmt.Errorf("Failed to remove %d objects, run uninstall again to retry", summary.failures)
+	}
+	return nil
+}
+
+// uninstallNamespace removes the service account references first, so that
+// no service account is left pointing to a deleted secret, and reports
+// whether the namespace had anything to remove
+func uninstallNamespace(k8s *k8sClient, out io.Writer, ns *corev1.Namespace, dryRun bool, summary *uninstallSummary) bool {
+	namespace := ns.Name
+	fail := func(err error) {
+		fmt.Fprintf(out, "[%s] Error: %v\n", namespace, err)
+		summary.failures++
+	}
+	secrets, err := listManagedSecrets(k8s, namespace)
+	if err != nil {
+		fail(err)
+		return false
+	}
+	var secretNames []string
+	for _, secret := range secrets {
+		secretNames = append(secretNames, secret.Name)
+	}
+
+	sas, err := k8s.clientset.CoreV1().ServiceAccounts(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		metricErrors.WithLabelValues(operationList).Inc()
+		fail(fmt.Errorf("Failed to list service accounts: %v", err))
+		return false
+	}
+	found := false
+	saFailed := false
+	for _, sa := range sas.Items {
+		// the secrets tracked on the service account, and the references to
+		// managed secrets added before they were tracked
+		names := append(trackedImagePullSecrets(&sa), secretNames...)
+		if !serviceAccountReferencesAny(&sa, names) {
+			continue
+		}
+		found = true
+		if dryRun {
+			fmt.Fprintf(out, "[%s] Service account [%s] would have its imagePullSecrets removed\n", namespace, sa.Name)
+			summary.serviceAccounts++
+			continue
+		}
+		if err := removeImagePullSecrets(k8s, &sa, names); err != nil {
+			fail(err)
+			saFailed = true
+			continue
+		}
+		fmt.Fprintf(out, "[%s] Service account [%s] had its imagePullSecrets removed\n", namespace, sa.Name)
+		summary.serviceAccounts++
+	}
+	// keep the secrets while a service account still references them
+	if saFailed {
+		return found
+	}
+
+	for _, secret := range secrets {
+		found = true
+		if dryRun {
+			fmt.Fprintf(out, "[%s] Secret [%s] would be deleted\n", namespace, secret.Name)
+			summary.secrets++
+			continue
+		}
+		err := k8s.clientset.CoreV1().Secrets(namespace).Delete(secret.Name, &metav1.DeleteOptions{
+			Preconditions: &metav1.Preconditions{UID: &secret.UID},
+		})
+		if err != nil && !errors.IsNotFound(err) {
+			metricErrors.WithLabelValues(operationDelete).Inc()
+			fail(fmt.Errorf("Failed to delete secret [%s]: %v", secret.Name, err))
+			continue
+		}
+		fmt.Fprintf(out, "[%s] Secret [%s] deleted\n", namespace, secret.Name)
+		k8s.recordSecretEvent(ns, secret, corev1.EventTypeNormal, eventReasonSecretDeleted, "Deleted secret [%s] on uninstall", secret.Name)
+		summary.secrets++
+	}
+	return found
+}
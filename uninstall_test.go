@@ -0,0 +1,175 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newUninstallTestClient() *fake.Clientset {
+	return fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "tracked"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "legacy"}},
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "untouched"}},
+		dockerconfigSecret("tracked", configSecretName, testDockerconfig),
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{Name: "other-secret", Namespace: "tracked"}},
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        defaultServiceAccountName,
+				Namespace:   "tracked",
+				Annotations: map[string]string{annotationImagepullsecretPatcherSecrets: configSecretName},
+			},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "other-secret"}, {Name: configSecretName}},
+		},
+		// created before the references were tracked
+		&corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+			Name:        configSecretName,
+			Namespace:   "legacy",
+			Annotations: map[string]string{annotationManagedBy: annotationAppName},
+		}},
+		&corev1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Name: defaultServiceAccountName, Namespace: "legacy"},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: configSecretName}},
+		},
+		&corev1.ServiceAccount{
+			ObjectMeta:       metav1.ObjectMeta{Name: defaultServiceAccountName, Namespace: "untouched"},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: "other-secret"}},
+		},
+	)
+}
+
+func TestUninstallDryRun(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	clientset := newUninstallTestClient()
+	k8s := &k8sClient{clientset: clientset}
+
+	var out bytes.Buffer
+	if err := uninstall(k8s, &out, true); err != nil {
+		t.Fatalf("uninstall has error %v", err)
+	}
+	for _, line := range []string{
+		"[tracked] Service account [default] would have its imagePullSecrets removed",
+		"[tracked] Secret [image-pull-secret] would be deleted",
+		"[legacy] Service account [default] would have its imagePullSecrets removed",
+		"[legacy] Secret [image-pull-secret] would be deleted",
+		"Would remove 2 secrets and the image pull secrets of 2 service accounts in 2 namespaces",
+	} {
+		if !strings.Contains(out.String(), line+"\n") {
+			t.Errorf("uninstall output should contain %q, got:\n%s", line, out.String())
+		}
+	}
+	for _, action := range clientset.Actions() {
+		if action.GetVerb() != "get" && action.GetVerb() != "list" {
+			t.Errorf("uninstall dry run should not change anything, but called %s %s", action.GetVerb(), action.GetResource().Resource)
+		}
+	}
+}
+
+func TestUninstall(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	clientset := newUninstallTestClient()
+	k8s := &k8sClient{clientset: clientset}
+
+	var out bytes.Buffer
+	if err := uninstall(k8s, &out, false); err != nil {
+		t.Fatalf("uninstall has error %v", err)
+	}
+	for _, namespace := range []string{"tracked", "legacy"} {
+		if _, err := clientset.CoreV1().Secrets(namespace).Get(configSecretName, metav1.GetOptions{}); !errors.IsNotFound(err) {
+			t.Errorf("uninstall should delete the managed secret in namespace [%s]", namespace)
+		}
+		sa, err := clientset.CoreV1().ServiceAccounts(namespace).Get(defaultServiceAccountName, metav1.GetOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if includeImagePullSecret(sa, configSecretName) {
+			t.Errorf("uninstall should remove the managed secret from the service account in namespace [%s]", namespace)
+		}
+		if _, ok := sa.Annotations[annotationImagepullsecretPatcherSecrets]; ok {
+			t.Errorf("uninstall should remove the tracking annotation in namespace [%s]", namespace)
+		}
+	}
+	if _, err := clientset.CoreV1().Secrets("tracked").Get("other-secret", metav1.GetOptions{}); err != nil {
+		t.Errorf("uninstall should keep unmanaged secrets, got %v", err)
+	}
+	sa, err := clientset.CoreV1().ServiceAccounts("untouched").Get(defaultServiceAccountName, metav1.GetOptions{})
+	if err != nil || !includeImagePullSecret(sa, "other-secret") {
+		t.Errorf("uninstall should keep image pull secrets it did not add")
+	}
+	if line := "Removed 2 secrets and the image pull secrets of 2 service accounts in 2 namespaces\n"; !strings.Contains(out.String(), line) {
+		t.Errorf("uninstall output should contain %q, got:\n%s", line, out.String())
+	}
+}
+
+func TestUninstallFailure(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	clientset := newUninstallTestClient()
+	clientset.PrependReactor("patch", "serviceaccounts", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetNamespace() == "legacy" {
+			return true, nil, fmt.Errorf("connection refused")
+		}
+		return false, nil, nil
+	})
+	k8s := &k8sClient{clientset: clientset}
+
+	if err := uninstall(k8s, ioutil.Discard, false); err == nil {
+		t.Errorf("uninstall expects error when a service account cannot be patched")
+	}
+	// the secret is kept while a service account still references it
+	if _, err := clientset.CoreV1().Secrets("legacy").Get(configSecretName, metav1.GetOptions{}); err != nil {
+		t.Errorf("uninstall should keep the secret of a service account failing to patch, got %v", err)
+	}
+	if _, err := clientset.CoreV1().Secrets("tracked").Get(configSecretName, metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("uninstall should go on with other namespaces after a failure")
+	}
+}
+
+func TestUninstallKeepsOtherInstances(t *testing.T) {
+	logrus.SetOutput(ioutil.Discard)
+	teamSecret := dockerconfigSecret("shared", "team-secret", testDockerconfig)
+	teamSecret.Labels[labelInstance] = "team"
+	clientset := fake.NewSimpleClientset(
+		&corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: "shared"}},
+		dockerconfigSecret("shared", configSecretName, testDockerconfig),
+		teamSecret,
+		&corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        defaultServiceAccountName,
+				Namespace:   "shared",
+				Annotations: map[string]string{annotationImagepullsecretPatcherSecrets: configSecretName + ",team/team-secret"},
+			},
+			ImagePullSecrets: []corev1.LocalObjectReference{{Name: configSecretName}, {Name: "team-secret"}},
+		},
+	)
+	k8s := &k8sClient{clientset: clientset}
+
+	if err := uninstall(k8s, ioutil.Discard, false); err != nil {
+		t.Fatalf("uninstall has error %v", err)
+	}
+	if _, err := clientset.CoreV1().Secrets("shared").Get(configSecretName, metav1.GetOptions{}); !errors.IsNotFound(err) {
+		t.Errorf("uninstall should delete the secret of its instance")
+	}
+	if _, err := clientset.CoreV1().Secrets("shared").Get("team-secret", metav1.GetOptions{}); err != nil {
+		t.Errorf("uninstall should keep the secret of another instance, got %v", err)
+	}
+	sa, err := clientset.CoreV1().ServiceAccounts("shared").Get(defaultServiceAccountName, metav1.GetOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if includeImagePullSecret(sa, configSecretName) || !includeImagePullSecret(sa, "team-secret") {
+		t.Errorf("uninstall should only remove the image pull secrets of its instance, got %v", sa.ImagePullSecrets)
+	}
+	if tracked := sa.Annotations[annotationImagepullsecretPatcherSecrets]; tracked != "team/team-secret" {
+		t.Errorf("uninstall should keep the tracked secrets of another instance, got %q", tracked)
+	}
+}
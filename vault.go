@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// prefix of the Vault credential source specs, `vault:<mount>/<path>`
+	// of a secret in a KV version 2 secrets engine
+	credentialSourceVault = "vault:"
+
+	vaultHTTPTimeout = 30 * time.Second
+	// how long before its expiry a Vault token is renewed by logging in again
+	vaultTokenSkew = time.Minute
+)
+
+// vaultServiceAccountTokenPath is the token of the patcher's service account
+// used for the Kubernetes auth method, a variable so that tests can replace it
+var vaultServiceAccountTokenPath = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+
+// vaultCredentialSource reads a registry, a username and a password from a
+// Vault KV version 2 secret, and reads it again once its lease, or
+// `CONFIG_VAULT_REFRESH_INTERVAL` when it has none, has expired
+type vaultCredentialSource struct {
+	mount  string
+	path   string
+	client *http.Client
+	now    func() time.Time
+
+	payload expiringCredential
+
+	// token of the Kubernetes auth method, the token file is read every time
+	tokenLock      sync.Mutex
+	token          string
+	tokenExpiresAt time.Time
+}
+
+func newVaultCredentialSource(spec string) (*vaultCredentialSource, error) {
+	parts := strings.SplitN(strings.Trim(spec, "/"), "/", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return nil, fmt.Errorf("Invalid Vault source [%s], expects `<mount>/<path>`", spec)
+	}
+	if configVaultAddr == "" {
+		return nil, fmt.Errorf("Vault source [%s] needs `vault-addr`", spec)
+	}
+	if configVaultAuthRole == "" && configVaultTokenPath == "" {
+		return nil, fmt.Errorf("Vault source [%s] needs `vault-auth-role` or `vault-token-path`", spec)
+	}
+	if configVaultAuthRole != "" && configVaultTokenPath != "" {
+		return nil, fmt.Errorf("Cannot specify `vault-auth-role` together with `vault-token-path`")
+	}
+	if len(vaultFields()) != 3 {
+		return nil, fmt.Errorf("Invalid `vault-fields` [%s], expects the fields of the registry, username and password like `registry,username,password`", configVaultFields)
+	}
+	return &vaultCredentialSource{
+		mount:  parts[0],
+		path:   parts[1],
+		client: &http.Client{Timeout: vaultHTTPTimeout},
+		now:    time.Now,
+	}, nil
+}
+
+// vaultFields returns the names of the registry, username and password
+// fields of the Vault secrets
+func vaultFields() []string {
+	var fields []string
+	for _, field := range strings.Split(configVaultFields, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			fields = append(fields, field)
+		}
+	}
+	return fields
+}
+
+func (s *vaultCredentialSource) DockerConfigJSON() (string, error) {
+	return s.payload.get(s.now(), 0, s.read)
+}
+
+type vaultKVResponse struct {
+	LeaseDuration int64 `json:"lease_duration"`
+	Data          struct {
+		Data map[string]interface{} `json:"data"`
+	} `json:"data"`
+}
+
+// read reads the secret and builds its dockerconfigjson payload
+func (s *vaultCredentialSource) read() (string, time.Time, error) {
+	token, err := s.vaultToken()
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req, err := http.NewRequest(http.MethodGet, fmt.Sprintf("%s/v1/%s/data/%s", strings.TrimSuffix(configVaultAddr, "/"), s.mount, s.path), nil)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	req.Header.Set("X-Vault-Token", token)
+	var secret vaultKVResponse
+	status, err := s.do(req, &secret)
+	if status == http.StatusForbidden {
+		// the token may have been revoked, log in again next time
+		s.resetToken()
+	}
+	if err != nil {
+		return "", time.Time{}, fmt.Errorf("Failed to read Vault secret [%s/%s]: %v", s.mount, s.path, err)
+	}
+
+	fields := vaultFields()
+	values := make([]string, len(fields))
+	for i, field := range fields {
+		value, ok := secret.Data.Data[field].(string)
+		if !ok || value == "" {
+			return "", time.Time{}, fmt.Errorf("Vault secret [%s/%s] has no field %s", s.mount, s.path, field)
+		}
+		values[i] = value
+	}
+	dockerConfigJSON, err := registriesDockerConfigJSON([]string{values[0]}, values[1], values[2])
+	ttl := configVaultRefreshInterval
+	if secret.LeaseDuration > 0 {
+		ttl = time.Duration(secret.LeaseDuration) * time.Second
+	}
+	return dockerConfigJSON, s.now().Add(ttl), err
+}
+
+// vaultToken returns the token of the token file, or logs in with the
+// Kubernetes auth method once the previous token is about to expire
+func (s *vaultCredentialSource) vaultToken() (string, error) {
+	if configVaultAuthRole == "" {
+		b, err := ioutil.ReadFile(configVaultTokenPath)
+		if err != nil {
+			return "", fmt.Errorf("Failed to read Vault token: %v", err)
+		}
+		return strings.TrimSpace(string(b)), nil
+	}
+
+	s.tokenLock.Lock()
+	defer s.tokenLock.Unlock()
+	if s.token != "" && (s.tokenExpiresAt.IsZero() || s.now().Before(s.tokenExpiresAt.Add(-vaultTokenSkew))) {
+		return s.token, nil
+	}
+	jwt, err := ioutil.ReadFile(vaultServiceAccountTokenPath)
+	if err != nil {
+		return "", fmt.Errorf("Failed to read service account token: %v", err)
+	}
+	body, err := json.Marshal(map[string]string{"role": configVaultAuthRole, "jwt": strings.TrimSpace(string(jwt))})
+	if err != nil {
+		return "", err
+	}
+	req, err := http.NewRequest(http.MethodPost, fmt.Sprintf("%s/v1/auth/%s/login", strings.TrimSuffix(configVaultAddr, "/"), configVaultAuthMount), bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	var login struct {
+		Auth struct {
+			ClientToken   string `json:"client_token"`
+			LeaseDuration int64  `json:"lease_duration"`
+		} `json:"auth"`
+	}
+	if _, err := s.do(req, &login); err != nil {
+		return "", fmt.Errorf("Failed to log in to Vault with role [%s]: %v", configVaultAuthRole, err)
+	}
+	if login.Auth.ClientToken == "" {
+		return "", fmt.Errorf("Vault returned no token for role [%s]", configVaultAuthRole)
+	}
+	s.token = login.Auth.ClientToken
+	s.tokenExpiresAt = time.Time{}
+	if login.Auth.LeaseDuration > 0 {
+		s.tokenExpiresAt = s.now().Add(time.Duration(login.Auth.LeaseDuration) * time.Second)
+	}
+	return s.token, nil
+}
+
+func (s *vaultCredentialSource) resetToken() {
+	s.tokenLock.Lock()
+	defer s.tokenLock.Unlock()
+	s.token = ""
+}
+
+// do sends a request to Vault and decodes its response into v, returning
+// the status code
+func (s *vaultCredentialSource) do(req *http.Request, v interface{}) (int, error) {
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return resp.StatusCode, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, fmt.Errorf("%s %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return resp.StatusCode, json.Unmarshal(body, v)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newVaultTestServer serves the Kubernetes auth method and a KV version 2
+// secret at `secret/registries/harbor` holding the given password
+func newVaultTestServer(password *string, logins *int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/auth/kubernetes/login":
+			var login map[string]string
+			json.NewDecoder(r.Body).Decode(&login)
+			if login["role"] != "imagepullsecret-patcher" || login["jwt"] != "service-account-token" {
+				http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+				return
+			}
+			*logins++
+			fmt.Fprintf(w, `{"auth":{"client_token":"k8s-token-%d","lease_duration":3600}}`, *logins)
+		case "/v1/secret/data/registries/harbor":
+			token := r.Header.Get("X-Vault-Token")
+			if token != fmt.Sprintf("k8s-token-%d", *logins) && token != "file-token" {
+				http.Error(w, `{"errors":["permission denied"]}`, http.StatusForbidden)
+				return
+			}
+			fmt.Fprintf(w, `{"lease_duration":0,"data":{"data":{"registry":"harbor.example.com","username":"robot","password":%q},"metadata":{"version":1}}}`, *password)
+		default:
+			http.Error(w, `{"errors":[]}`, http.StatusNotFound)
+		}
+	}))
+}
+
+func TestVaultCredentialSource(t *testing.T) {
+	password, logins := "password-1", 0
+	server := newVaultTestServer(&password, &logins)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "imagepullsecret-patcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saTokenPath := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(saTokenPath, []byte("service-account-token"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	defaultSATokenPath := vaultServiceAccountTokenPath
+	vaultServiceAccountTokenPath = saTokenPath
+	configVaultAddr, configVaultAuthRole = server.URL, "imagepullsecret-patcher"
+	defer func() {
+		vaultServiceAccountTokenPath = defaultSATokenPath
+		configVaultAddr, configVaultAuthRole = "", ""
+	}()
+
+	source, err := newVaultCredentialSource("secret/registries/harbor")
+	if err != nil {
+		t.Fatalf("newVaultCredentialSource has error %v", err)
+	}
+	now := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := now
+	source.now = func() time.Time { return clock }
+
+	actual, err := source.DockerConfigJSON()
+	if err != nil {
+		t.Fatalf("Vault credential source has error %v", err)
+	}
+	expected, _ := registriesDockerConfigJSON([]string{"harbor.example.com"}, "robot", "password-1")
+	if actual != expected {
+		t.Errorf("Vault credential source expects %s but got %s", expected, actual)
+	}
+
+	// the secret is read again once the refresh interval has passed
+	password = "password-2"
+	clock = now.Add(time.Minute)
+	if actual, _ := source.DockerConfigJSON(); actual != expected {
+		t.Errorf("Vault credential source expects the secret to be reused within the refresh interval")
+	}
+	clock = now.Add(configVaultRefreshInterval)
+	expected, _ = registriesDockerConfigJSON([]string{"harbor.example.com"}, "robot", "password-2")
+	if actual, _ := source.DockerConfigJSON(); actual != expected || logins != 1 {
+		t.Errorf("Vault credential source expects %s with 1 login but got %s with %d logins", expected, actual, logins)
+	}
+
+	// it logs in again before the token expires
+	clock = now.Add(time.Hour)
+	if _, err := source.DockerConfigJSON(); err != nil || logins != 2 {
+		t.Errorf("Vault credential source expects to log in again, got %d logins, error %v", logins, err)
+	}
+}
+
+func TestVaultCredentialSourceTokenFile(t *testing.T) {
+	password, logins := "password-1", 0
+	server := newVaultTestServer(&password, &logins)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "imagepullsecret-patcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenPath := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenPath, []byte("file-token\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	configVaultAddr, configVaultTokenPath, configVaultFields = server.URL, tokenPath, "registry,username,missing"
+	defer func() {
+		configVaultAddr, configVaultTokenPath, configVaultFields = "", "", "registry,username,password"
+	}()
+
+	source, err := newVaultCredentialSource("secret/registries/harbor")
+	if err != nil {
+		t.Fatalf("newVaultCredentialSource has error %v", err)
+	}
+	if _, err := source.DockerConfigJSON(); err == nil {
+		t.Errorf("Vault credential source expects error for a missing field")
+	}
+
+	configVaultFields = "registry,username,password"
+	actual, err := source.DockerConfigJSON()
+	if err != nil {
+		t.Fatalf("Vault credential source has error %v", err)
+	}
+	expected, _ := registriesDockerConfigJSON([]string{"harbor.example.com"}, "robot", "password-1")
+	if actual != expected || logins != 0 {
+		t.Errorf("Vault credential source expects %s without login but got %s with %d logins", expected, actual, logins)
+	}
+}
+
+func TestNewVaultCredentialSource(t *testing.T) {
+	defer func() { configVaultAddr, configVaultTokenPath, configVaultAuthRole = "", "", "" }()
+	for _, testCase := range []struct {
+		name     string
+		addr     string
+		role     string
+		spec     string
+		hasError bool
+	}{
+		{name: "valid", addr: "https://vault:8200", spec: "secret/registries/harbor"},
+		{name: "no path", addr: "https://vault:8200", spec: "secret", hasError: true},
+		{name: "no address", spec: "secret/registries/harbor", hasError: true},
+		{name: "both auth role and token path", addr: "https://vault:8200", role: "patcher", spec: "secret/registries/harbor", hasError: true},
+	} {
+		configVaultAddr, configVaultTokenPath, configVaultAuthRole = testCase.addr, "/vault/token", testCase.role
+		_, err := newVaultCredentialSource(testCase.spec)
+		if testCase.hasError != (err != nil) {
+			t.Errorf("newVaultCredentialSource(%s) expects error %v but got %v", testCase.name, testCase.hasError, err)
+		}
+	}
+}
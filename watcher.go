@@ -0,0 +1,74 @@
+package main
+
+import (
+	"path/filepath"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	log "github.com/sirupsen/logrus"
+)
+
+// name of the symlink kubelet swaps atomically when it updates a mounted
+// secret, the files of the volume being symlinks through it
+const kubeletDataDir = "..data"
+
+// credentialWatchDebounce is how long the watcher waits for a burst of file
+// events to settle before reloading, a variable so that tests can shorten it
+var credentialWatchDebounce = time.Second
+
+// credentialFilePaths returns the paths of all file credential sources
+func credentialFilePaths() []string {
+	var paths []string
+	for _, ms := range allCredentials() {
+		if path, ok := ms.source.(fileCredentialSource); ok {
+			paths = append(paths, filepath.Clean(string(path)))
+		}
+	}
+	return paths
+}
+
+// watchCredentialFiles calls onChange after the given files have changed,
+// once per burst of events, until stopCh is closed. It watches the parent
+// directories rather than the files, because a mounted secret is updated by
+// swapping the `..data` symlink, which replaces the files instead of writing
+// to them.
+func watchCredentialFiles(paths []string, onChange func(), stopCh <-chan struct{}) error {
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	watched := map[string]bool{}
+	for _, path := range paths {
+		watched[path] = true
+		if err := watcher.Add(filepath.Dir(path)); err != nil {
+			watcher.Close()
+			return err
+		}
+	}
+
+	go func() {
+		defer watcher.Close()
+		// fires once the events have settled, stopped until the first event
+		debounce := time.NewTimer(credentialWatchDebounce)
+		debounce.Stop()
+		for {
+			select {
+			case event := <-watcher.Events:
+				name := filepath.Clean(event.Name)
+				if !watched[name] && filepath.Base(name) != kubeletDataDir {
+					continue
+				}
+				log.Debugf("Credential file event %s", event)
+				debounce.Reset(credentialWatchDebounce)
+			case err := <-watcher.Errors:
+				log.Warnf("Failed to watch credential files: %v", err)
+			case <-debounce.C:
+				onChange()
+			case <-stopCh:
+				debounce.Stop()
+				return
+			}
+		}
+	}()
+	return nil
+}
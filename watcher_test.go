@@ -0,0 +1,97 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// writeKubeletVolume writes a file the way kubelet updates a mounted secret:
+// into a new timestamped directory, then swapping the `..data` symlink to it
+func writeKubeletVolume(t *testing.T, dir, version, key, content string) {
+	versionDir := filepath.Join(dir, "..2020_"+version)
+	if err := os.Mkdir(versionDir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(versionDir, key), []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	tmp := filepath.Join(dir, "..data_tmp")
+	if err := os.Symlink(filepath.Base(versionDir), tmp); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmp, filepath.Join(dir, kubeletDataDir)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(dir, key)); os.IsNotExist(err) {
+		if err := os.Symlink(filepath.Join(kubeletDataDir, key), filepath.Join(dir, key)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWatchCredentialFiles(t *testing.T) {
+	credentialWatchDebounce = 100 * time.Millisecond
+	defer func() {
+		credentialWatchDebounce = time.Second
+	}()
+	dir, err := ioutil.TempDir("", "imagepullsecret-patcher")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeKubeletVolume(t, dir, "a", ".dockerconfigjson", `{"auths":{}}`)
+	path := filepath.Join(dir, ".dockerconfigjson")
+
+	changes := make(chan struct{}, 10)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	if err := watchCredentialFiles([]string{path}, func() { changes <- struct{}{} }, stopCh); err != nil {
+		t.Fatal(err)
+	}
+
+	// unrelated files in the same directory are ignored
+	if err := ioutil.WriteFile(filepath.Join(dir, "other"), []byte("other"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+		t.Errorf("watcher should ignore unrelated files")
+	case <-time.After(3 * credentialWatchDebounce):
+	}
+
+	// the symlink swap is a burst of several events, reported once
+	writeKubeletVolume(t, dir, "b", ".dockerconfigjson", testDockerconfig)
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not report the symlink swap")
+	}
+	select {
+	case <-changes:
+		t.Errorf("watcher should debounce the events of a single swap")
+	case <-time.After(3 * credentialWatchDebounce):
+	}
+	if value, _ := fileCredentialSource(path).DockerConfigJSON(); value != testDockerconfig {
+		t.Errorf("credential file gives %s after the swap, expects %s", value, testDockerconfig)
+	}
+
+	// a file written in place is reported as well
+	plain := filepath.Join(dir, "plain.json")
+	if err := ioutil.WriteFile(plain, []byte(testDockerconfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := watchCredentialFiles([]string{plain}, func() { changes <- struct{}{} }, stopCh); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(plain, []byte(`{"auths":{}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-changes:
+	case <-time.After(5 * time.Second):
+		t.Fatal("watcher did not report the file write")
+	}
+}